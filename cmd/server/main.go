@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,14 +13,41 @@ import (
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/grpc/server"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/broker"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jaeger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/outbox"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/prometheus"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/workspace"
 	"google.golang.org/grpc"
 )
 
 func main() {
 	logger.Init()
-	config.Init()
+
+	if len(os.Args) > 1 && os.Args[1] == "reencode" {
+		reencode(os.Args[2:])
+		return
+	}
+
+	var opts config.Options
+	flag.StringVar(&opts.EnvFile, "env-file", "", "path of the .env file to load (overrides ENV_FILE)")
+	flag.StringVar(&opts.WorkspaceDir, "workspace-dir", "", "directory jobs are processed in (overrides WORKSPACE_DIR)")
+	flag.Parse()
+
+	config.Init(opts)
+
+	if err := workspace.Init(config.Conf.Workspace.Dir); err != nil {
+		logger.Fatal("Workspace init failed: %v", err)
+	}
+	workspace.SweepOrphans(config.Conf.Workspace.OrphanMaxAgeSeconds)
+
+	if err := jobstore.Init(config.Conf.Job.StoreDriver, config.Conf.Job.StorePath); err != nil {
+		logger.Fatal("Job store init failed: %v", err)
+	}
+
+	if err := outbox.Init(config.Conf.Outbox.Path); err != nil {
+		logger.Fatal("Outbox init failed: %v", err)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -34,6 +62,12 @@ func main() {
 		}
 	}()
 
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.Relay(ctx, config.Conf.Outbox.RelayIntervalSeconds)
+	}()
+
 	promServer := prometheus.NewServer()
 	go func() {
 		if err := prometheus.Serve(promServer); err != nil && err != http.ErrServerClosed {
@@ -66,5 +100,14 @@ func main() {
 
 	grpcServer.GracefulStop()
 
+	if err := jobstore.S.Close(); err != nil {
+		logger.Warn("Job store close error: %v", err)
+	}
+
+	<-relayDone
+	if err := outbox.Close(); err != nil {
+		logger.Warn("Outbox close error: %v", err)
+	}
+
 	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/broker"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/publisher"
+	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+)
+
+// reencode publishes a ReEncodeVideo message for every given video, or every
+// raw video found in S3 with -scan, so the running replicas re-encode them.
+func reencode(args []string) {
+	fs := flag.NewFlagSet("reencode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reencode [flags] [video id...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	var opts config.Options
+	fs.StringVar(&opts.EnvFile, "env-file", "", "path of the .env file to load (overrides ENV_FILE)")
+	profile := fs.String("profile", "", "encode profile to use (defaults to ENCODER_PROFILE)")
+	version := fs.String("version", "v"+time.Now().UTC().Format("20060102150405"), "name of the output directory under each video's prefix")
+	priority := fs.Uint("priority", 0, "AMQP priority of the messages, used when the queue has AMQP_QUEUE_MAX_PRIORITY")
+	scan := fs.Bool("scan", false, "re-encode every raw video in S3 instead of the given ids")
+	prefix := fs.String("prefix", "", "with -scan, only re-encode raw videos whose id starts with prefix")
+	dryRun := fs.Bool("dry-run", false, "list the videos without publishing anything")
+	fs.Parse(args)
+
+	config.Init(opts)
+
+	if *profile != "" {
+		if _, ok := ve.GetEncodeProfile(*profile); !ok {
+			logger.Fatal("Unknown encode profile %q", *profile)
+		}
+	}
+
+	if *priority > 255 {
+		logger.Fatal("Priority %d is out of range 0-255", *priority)
+	}
+
+	videoIds := fs.Args()
+
+	if *scan {
+		ids, err := rawVideoIds(*prefix)
+		if err != nil {
+			logger.Fatal("Unable to list raw videos: %v", err)
+		}
+
+		videoIds = append(videoIds, ids...)
+	}
+
+	if len(videoIds) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	messages := []*amqphandler.ReEncodeVideoMessage{}
+	for _, id := range videoIds {
+		m := &amqphandler.ReEncodeVideoMessage{
+			VideoId: id,
+			Profile: *profile,
+			Version: *version,
+		}
+
+		if err := m.Validate(); err != nil {
+			logger.Fatal("Video %q: %v", id, err)
+		}
+
+		messages = append(messages, m)
+	}
+
+	if *dryRun {
+		for _, m := range messages {
+			fmt.Println(m.VideoId)
+		}
+
+		logger.Info("%d videos would be re-encoded into version %q", len(messages), *version)
+
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	closeConn, err := broker.ConnectPublisher()
+	if err != nil {
+		logger.Fatal("AMQP connection failed: %v", err)
+	}
+	defer closeConn()
+
+	failed := 0
+	for _, m := range messages {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := publisher.P.Publish(ctx, &publisher.MessageType{
+			Key:      constant.MessageTypeReEncodeVideo,
+			Data:     m,
+			Priority: uint8(*priority),
+		})
+		if err != nil {
+			logger.Error("Unable to queue re-encode of video %q: %v", m.VideoId, err)
+			failed++
+		}
+	}
+
+	logger.Info("Queued re-encode of %d of %d videos into version %q", len(messages)-failed, len(messages), *version)
+
+	if failed > 0 || ctx.Err() != nil {
+		closeConn()
+		os.Exit(1)
+	}
+}
+
+// rawVideoIds lists the ids of the raw videos in S3 starting with prefix.
+func rawVideoIds(prefix string) ([]string, error) {
+	dir := constant.S3RawVideosDirectory + "/"
+
+	keys, err := aws.ListS3Objects(dir + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, dir)
+
+		// Raw videos are stored right under the directory.
+		if id == "" || strings.Contains(id, "/") {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
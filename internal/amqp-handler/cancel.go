@@ -0,0 +1,167 @@
+package amqphandler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/outbox"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/workspace"
+)
+
+var ErrMissingVideoId = fmt.Errorf("%w: video_id is required", ErrInvalidMessage)
+
+type CancelEncodeMessage struct {
+	VideoId string `json:"video_id"`
+}
+
+type VideoEncodingCancelledMessage struct {
+	VideoId     string `json:"video_id"`
+	CancelledAt string `json:"cancelled_at"`
+}
+
+// cancellationMarker tells every replica that the video must not be encoded.
+// An empty SourceETag cancels any upload of the video, e.g. when the raw video
+// was already deleted.
+type cancellationMarker struct {
+	SourceETag  string    `json:"source_etag"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+func ProcessCancelEncodeMessage(ctx context.Context, data *CancelEncodeMessage) error {
+	_, err := CancelEncode(ctx, data.VideoId)
+
+	return err
+}
+
+// CancelEncode stops the encoding of a video wherever it runs, be it an
+// upload or a re-encode. The job running in this process is cancelled right
+// away; one running on another replica sees the cancellation when it next
+// renews its lease, and queued messages of the video are dropped when they're
+// received. It returns false when no job runs and the video was already
+// encoded, in which case nothing is cancelled.
+func CancelEncode(ctx context.Context, videoId string) (bool, error) {
+	if err := validateVideoId(videoId); err != nil {
+		return false, err
+	}
+
+	objectKey := path.Join(constant.S3RawVideosDirectory, videoId)
+
+	sourceETag, _, err := headSource(objectKey)
+	if err != nil && !aws.IsNotFound(err) {
+		return false, err
+	}
+
+	lease := new(processingLease)
+
+	found, err := getJSONObject(path.Join(constant.S3EncodedVideosDirectory, videoId, constant.ProcessingLeaseFile), lease)
+	if err != nil {
+		return false, err
+	}
+
+	leased := found && time.Now().Before(lease.ExpiresAt)
+
+	// An encoded video may still be re-encoded, so the completion only
+	// counts when no job runs.
+	if !leased && !IsInProgress(videoId) {
+		marker, err := getCompletionMarker(path.Join(constant.S3EncodedVideosDirectory, videoId))
+		if err != nil {
+			return false, err
+		}
+
+		if marker != nil && (sourceETag == "" || marker.SourceETag == sourceETag) {
+			logger.Info("Video %s is already encoded, nothing to cancel", videoId)
+
+			return false, nil
+		}
+	}
+
+	err = putJSONObject(cancellationMarkerKey(videoId), &cancellationMarker{
+		SourceETag:  sourceETag,
+		CancelledAt: time.Now(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if cancelVideo(videoId) {
+		// The job cleans up after itself once it stopped.
+		return true, nil
+	}
+
+	if leased {
+		logger.Info("Video %s is encoded by %s, it will stop on its next lease renewal", videoId, lease.Owner)
+
+		return true, nil
+	}
+
+	return true, cleanupCancelledJob(ctx, videoId)
+}
+
+// isCancelled reports whether a cancellation of the video applies to the
+// upload with sourceETag.
+func isCancelled(videoId string, sourceETag string) (bool, error) {
+	m := new(cancellationMarker)
+
+	found, err := getJSONObject(cancellationMarkerKey(videoId), m)
+	if err != nil || !found {
+		return false, err
+	}
+
+	return m.SourceETag == "" || m.SourceETag == sourceETag, nil
+}
+
+// cleanupCancelledJob deletes what a cancelled upload of the video uploaded or
+// left in its workspace and tells other services about the cancellation. The
+// cancellation marker is kept so redelivered messages are dropped too.
+func cleanupCancelledJob(ctx context.Context, videoId string) error {
+	prefix := path.Join(constant.S3EncodedVideosDirectory, videoId) + "/"
+
+	keys, err := aws.ListS3Objects(prefix)
+	if err != nil {
+		return err
+	}
+
+	partial := []string{}
+	for _, k := range keys {
+		// The output of an upload is stored right under the prefix, the
+		// directories below are the versions of re-encodes.
+		if k != cancellationMarkerKey(videoId) && !strings.Contains(strings.TrimPrefix(k, prefix), "/") {
+			partial = append(partial, k)
+		}
+	}
+
+	if err := aws.DeleteS3Objects(partial); err != nil {
+		return err
+	}
+
+	logger.Info("Deleted %d objects of cancelled video %s", len(partial), videoId)
+
+	workspace.Remove(videoId)
+
+	now := time.Now()
+
+	jobstore.S.Update(videoId, func(j *jobstore.Job) {
+		if j.Status.IsFinal() && j.Status != jobstore.StatusFailed {
+			return
+		}
+
+		j.Status = jobstore.StatusCancelled
+		j.FinishedAt = &now
+	})
+
+	return outbox.Add(ctx, constant.MessageTypeVideoEncodingCancelled, &VideoEncodingCancelledMessage{
+		VideoId:     videoId,
+		CancelledAt: now.UTC().Format(time.RFC3339),
+	})
+}
+
+func cancellationMarkerKey(videoId string) string {
+	return path.Join(constant.S3EncodedVideosDirectory, videoId, constant.CancellationMarkerFile)
+}
@@ -0,0 +1,145 @@
+package amqphandler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+	ffmpeglib "github.com/u2takey/ffmpeg-go"
+)
+
+// encodeRenditionsInChunks splits the source into chunks, encodes every chunk
+// to all renditions in parallel and joins the chunks of each rendition.
+func encodeRenditionsInChunks(ctx context.Context, in string, renditions []*rendition, workDir string) error {
+	c := config.Conf.Encoder
+	start := time.Now()
+
+	chunkDir := path.Join(workDir, constant.ChunksDirectory)
+	if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
+		logger.Error("Unable to create chunks directory %q: %v", chunkDir, err)
+		return err
+	}
+
+	chunks, err := ve.SplitVideo(ctx, in, chunkDir, int(c.ChunkDurationSeconds.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	workers := max(1, min(c.ChunkWorkers, len(chunks)))
+
+	logger.Info("Encoding %d chunks of %q with %d workers", len(chunks), in, workers)
+
+	// encoded[i][j] is chunk i encoded to rendition j.
+	encoded := make([][]ve.RenditionOutput, len(chunks))
+	for i, chunk := range chunks {
+		for _, r := range renditions {
+			encoded[i] = append(encoded[i], ve.RenditionOutput{
+				Path: fmt.Sprintf("%s_%s.mp4", strings.TrimSuffix(chunk, path.Ext(chunk)), r.Name),
+				Args: chunkArgs(r.Args, workers),
+			})
+		}
+	}
+
+	if err := runChunkWorkers(ctx, chunks, encoded, workers); err != nil {
+		return err
+	}
+
+	for j, r := range renditions {
+		parts := []string{}
+		for i := range chunks {
+			parts = append(parts, encoded[i][j].Path)
+		}
+
+		video := path.Join(chunkDir, r.Name+".mp4")
+		if err := ve.ConcatVideos(ctx, parts, video); err != nil {
+			return err
+		}
+
+		if err := ve.MuxAudio(ctx, video, in, r.Video, r.Args.AudioCodec, r.Args.AudioBitRate); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Chunked encode of %q finished in %v", in, time.Since(start))
+
+	return os.RemoveAll(chunkDir)
+}
+
+// chunkArgs drops the audio, which is muxed back from the source after the
+// chunks are joined, and gives each worker a share of the cores.
+func chunkArgs(args *ve.EncodeVideoToResolutionArgs, workers int) *ve.EncodeVideoToResolutionArgs {
+	a := *args
+	a.ExtraArgs = ffmpeglib.KwArgs{
+		"an":      "",
+		"threads": max(1, runtime.NumCPU()/workers),
+	}
+
+	for k, v := range args.ExtraArgs {
+		a.ExtraArgs[k] = v
+	}
+
+	return &a
+}
+
+// runChunkWorkers encodes chunks[i] to the outputs in encoded[i] with a fixed
+// pool of workers. Once any chunk fails, the encodes of the others are
+// cancelled and pending chunks are skipped.
+func runChunkWorkers(ctx context.Context, chunks []string, encoded [][]ve.RenditionOutput, workers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	errs := make(chan error, len(chunks))
+	failed := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				if err := encodeChunk(ctx, chunks[i], encoded[i]); err != nil {
+					errs <- fmt.Errorf("chunk %q: %w", chunks[i], err)
+					once.Do(func() {
+						close(failed)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range chunks {
+		select {
+		case jobs <- i:
+		case <-failed:
+			break dispatch
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// encodeChunk recovers panics itself since they'd otherwise take down the
+// whole process from the worker goroutine.
+func encodeChunk(ctx context.Context, in string, outputs []ve.RenditionOutput) (err error) {
+	defer recoverPanic(constant.MessageTypeEncodeUploadedVideo, &err)
+
+	return encodeLadder(ctx, in, outputs)
+}
@@ -0,0 +1,265 @@
+package amqphandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+// ErrDuplicateInProgress is returned when the same job is already running in
+// this process, started from a message that settles once it finished.
+var ErrDuplicateInProgress = errors.New("video is already being encoded")
+
+// ErrVideoBusy is returned when another job of the video, e.g. a re-encode or
+// a job submitted through the API, runs in this process. The message must be
+// retried once it finished.
+var ErrVideoBusy = errors.New("another job of the video is running")
+
+// LeasedError is returned when another replica holds a valid lease of the
+// video. That replica may have died without releasing it, so the message must
+// be retried rather than dropped.
+type LeasedError struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (e *LeasedError) Error() string {
+	return fmt.Sprintf("video is leased by %s until %v", e.Owner, e.ExpiresAt)
+}
+
+// completionMarker is stored next to the encoded output once a video is done
+// so duplicates of the same upload re-publish it instead of re-encoding. The
+// marker of a re-encode carries the update event instead.
+type completionMarker struct {
+	SourceETag  string                         `json:"source_etag"`
+	CompletedAt time.Time                      `json:"completed_at"`
+	Message     *VideoEncodingCompletedMessage `json:"message,omitempty"`
+	Update      *VideoEncodingUpdatedMessage   `json:"update,omitempty"`
+}
+
+// processingLease tells other replicas that a video is being encoded. S3 has
+// no compare-and-set here, so two replicas starting at the same instant can
+// still both proceed; the lease catches every later duplicate.
+type processingLease struct {
+	Owner      string    `json:"owner"`
+	SourceETag string    `json:"source_etag"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+var inFlight = struct {
+	sync.Mutex
+	jobs map[string]*inFlightJob
+}{jobs: map[string]*inFlightJob{}}
+
+type inFlightJob struct {
+	jobId     string
+	submitted bool
+	cancel    context.CancelFunc
+}
+
+// acquireVideo makes sure only one job of a video runs in this process and
+// returns the context the job runs in, which cancelVideo cancels.
+func acquireVideo(ctx context.Context, j *encodeJob) (context.Context, func(), error) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	videoId := j.data.VideoId
+
+	if running, ok := inFlight.jobs[videoId]; ok {
+		if running.jobId == j.jobId() && !running.submitted && !j.submitted {
+			return nil, nil, ErrDuplicateInProgress
+		}
+
+		return nil, nil, fmt.Errorf("%w: %s", ErrVideoBusy, running.jobId)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	inFlight.jobs[videoId] = &inFlightJob{jobId: j.jobId(), submitted: j.submitted, cancel: cancel}
+
+	return ctx, func() {
+		inFlight.Lock()
+		defer inFlight.Unlock()
+
+		cancel()
+		delete(inFlight.jobs, videoId)
+	}, nil
+}
+
+// IsInProgress reports whether a job of the video runs in this process.
+func IsInProgress(videoId string) bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	_, ok := inFlight.jobs[videoId]
+
+	return ok
+}
+
+// cancelVideo cancels the job of the video running in this process. It
+// returns false when there is none.
+func cancelVideo(videoId string) bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	running, ok := inFlight.jobs[videoId]
+	if ok {
+		logger.Info("Cancelling job %s", running.jobId)
+		running.cancel()
+	}
+
+	return ok
+}
+
+// headSource returns the ETag and size of the raw video.
+func headSource(objectKey string) (string, int64, error) {
+	res, err := aws.HeadS3Object(objectKey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if res.ETag == nil {
+		return "", 0, fmt.Errorf("source %q has no ETag", objectKey)
+	}
+
+	var size int64
+	if res.ContentLength != nil {
+		size = *res.ContentLength
+	}
+
+	return *res.ETag, size, nil
+}
+
+// getCompletionMarker returns the marker of the output under prefix, if any.
+func getCompletionMarker(prefix string) (*completionMarker, error) {
+	m := new(completionMarker)
+
+	found, err := getJSONObject(path.Join(prefix, constant.CompletionMarkerFile), m)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func putCompletionMarker(prefix string, m *completionMarker) error {
+	return putJSONObject(path.Join(prefix, constant.CompletionMarkerFile), m)
+}
+
+// acquireLease claims the video for this replica and keeps renewing the claim
+// until the returned release func is called. The job is cancelled when a
+// renewal finds the video was cancelled meanwhile.
+func acquireLease(videoId string, sourceETag string) (func(), error) {
+	key := path.Join(constant.S3EncodedVideosDirectory, videoId, constant.ProcessingLeaseFile)
+	ttl := config.Conf.Job.LeaseSeconds
+	owner := leaseOwner()
+
+	existing := new(processingLease)
+
+	found, err := getJSONObject(key, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if found && existing.Owner != owner && existing.SourceETag == sourceETag && time.Now().Before(existing.ExpiresAt) {
+		logger.Warn("Video %s is leased by %s until %v", videoId, existing.Owner, existing.ExpiresAt)
+
+		return nil, &LeasedError{Owner: existing.Owner, ExpiresAt: existing.ExpiresAt}
+	}
+
+	renew := func() error {
+		return putJSONObject(key, &processingLease{
+			Owner:      owner,
+			SourceETag: sourceETag,
+			ExpiresAt:  time.Now().Add(ttl),
+		})
+	}
+
+	if err := renew(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := renew(); err != nil {
+					logger.Warn("Unable to renew lease of video %s: %v", videoId, err)
+				}
+
+				if cancelled, _ := isCancelled(videoId, sourceETag); cancelled {
+					cancelVideo(videoId)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+
+		if err := aws.DeleteS3Object(key); err != nil {
+			logger.Warn("Unable to release lease of video %s: %v", videoId, err)
+		}
+	}, nil
+}
+
+func leaseOwner() string {
+	hostname, _ := os.Hostname()
+
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func getJSONObject(key string, v any) (bool, error) {
+	res, err := aws.GetS3Object(key)
+	if aws.IsNotFound(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		logger.Error("Unable to read object %q: %v", key, err)
+		return false, err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		logger.Warn("Ignoring malformed object %q: %v", key, err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func putJSONObject(key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return aws.PutS3Object(key, b, constant.ContentTypeJSON)
+}
@@ -0,0 +1,198 @@
+package amqphandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/outbox"
+)
+
+// ErrAttemptsExhausted wraps the error of a job that failed on its last
+// allowed attempt, so its message is rejected instead of requeued.
+var ErrAttemptsExhausted = errors.New("job attempts exhausted")
+
+// ErrSourceNotFound is returned when the raw video doesn't exist, retrying the
+// job can't help then.
+var ErrSourceNotFound = errors.New("raw video not found")
+
+type VideoEncodingFailedMessage struct {
+	VideoId string `json:"video_id"`
+	// Version is set when a re-encode failed, the current output of the
+	// video is still valid then.
+	Version  string `json:"version,omitempty"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	FailedAt string `json:"failed_at"`
+}
+
+// jobRecord writes the progress of one attempt to the job store. Store errors
+// are only logged since they shouldn't fail the encode itself.
+type jobRecord struct {
+	ctx     context.Context
+	id      string
+	videoId string
+	version string
+	attempt int
+	// status is the outcome recorded by finish.
+	status jobstore.Status
+	// noRetry fails the job on its first failed attempt.
+	noRetry bool
+}
+
+// startJobRecord records a new attempt of the job. The attempts start over
+// when the previous run of the job is finished, e.g. a video uploaded again.
+func startJobRecord(ctx context.Context, data *VideoUploadedMessage, version string) *jobRecord {
+	r := &jobRecord{
+		ctx:     ctx,
+		id:      jobstore.JobId(data.VideoId, version),
+		videoId: data.VideoId,
+		version: version,
+	}
+
+	input, _ := json.Marshal(data)
+
+	j, err := jobstore.S.Update(r.id, func(j *jobstore.Job) {
+		if j.Status.IsFinal() {
+			j.Attempts = 0
+		}
+
+		j.VideoId = data.VideoId
+		j.Version = version
+
+		j.Attempts++
+		j.Status = jobstore.StatusRunning
+		j.Input = input
+		j.Error = ""
+		j.StartedAt = time.Now()
+		j.FinishedAt = nil
+	})
+	if err != nil {
+		logger.Warn("Unable to record job %s: %v", r.id, err)
+		return r
+	}
+
+	r.attempt = j.Attempts
+
+	logger.Info("Job %s attempt %d of %d", r.id, r.attempt, config.Conf.Job.MaxAttempts)
+
+	return r
+}
+
+func (r *jobRecord) update(fn func(j *jobstore.Job)) {
+	if _, err := jobstore.S.Update(r.id, fn); err != nil {
+		logger.Warn("Unable to record job %s: %v", r.id, err)
+	}
+}
+
+// begin records that the job entered the stage and returns the func that
+// records how long it took. It returns the context's error instead once the
+// job was cancelled.
+func (r *jobRecord) begin(name string) (func(error), error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s := &jobstore.StageTiming{
+		Name:      name,
+		Attempt:   r.attempt,
+		StartedAt: time.Now(),
+	}
+
+	r.update(func(j *jobstore.Job) {
+		j.Stage = name
+	})
+
+	return func(err error) {
+		s.Duration = time.Since(s.StartedAt)
+
+		if err != nil {
+			s.Error = err.Error()
+		}
+
+		r.update(func(j *jobstore.Job) {
+			j.Stages = append(j.Stages, s)
+		})
+	}, nil
+}
+
+func (r *jobRecord) metadata(info any, profile string) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	r.update(func(j *jobstore.Job) {
+		j.Metadata = b
+		j.Profile = profile
+	})
+}
+
+func (r *jobRecord) outputs(o *jobstore.Outputs) {
+	r.update(func(j *jobstore.Job) {
+		j.Outputs = o
+	})
+}
+
+// finish records the outcome of the attempt and wraps err with
+// ErrAttemptsExhausted once no attempts are left. A job that panicked, whose
+// source doesn't exist or that isn't retried fails on its first attempt.
+func (r *jobRecord) finish(err error) error {
+	now := time.Now()
+
+	if err == nil || errors.Is(err, context.Canceled) {
+		status := jobstore.StatusCompleted
+		if err != nil {
+			status = jobstore.StatusCancelled
+		}
+
+		r.status = status
+		r.update(func(j *jobstore.Job) {
+			j.Status = status
+			j.FinishedAt = &now
+		})
+
+		return err
+	}
+
+	status := jobstore.StatusRetrying
+	if errors.As(err, new(*PanicError)) || errors.Is(err, ErrSourceNotFound) || r.noRetry {
+		status = jobstore.StatusFailed
+	} else if r.attempt >= config.Conf.Job.MaxAttempts {
+		status = jobstore.StatusFailed
+		err = fmt.Errorf("%w after %d attempts: %w", ErrAttemptsExhausted, r.attempt, err)
+	}
+
+	r.status = status
+	r.update(func(j *jobstore.Job) {
+		j.Status = status
+		j.Error = err.Error()
+
+		if status == jobstore.StatusFailed {
+			j.FinishedAt = &now
+		}
+	})
+
+	if status == jobstore.StatusFailed {
+		addErr := outbox.Add(r.ctx, constant.MessageTypeVideoEncodingFailed, &VideoEncodingFailedMessage{
+			VideoId:  r.videoId,
+			Version:  r.version,
+			Error:    err.Error(),
+			Attempts: r.attempt,
+			FailedAt: now.UTC().Format(time.RFC3339),
+		})
+		if addErr != nil {
+			logger.Error("Unable to add failure of job %s to outbox: %v", r.id, addErr)
+
+			return errors.Join(err, addErr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,224 @@
+package amqphandler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/checkpoint"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+	ffmpeglib "github.com/u2takey/ffmpeg-go"
+)
+
+type rendition struct {
+	Option ve.VideoEncodeOption
+	Width  int
+	Height int
+	// Name is the "<width>x<height>" prefix of the rendition's files.
+	Name  string
+	Video string
+	Args  *ve.EncodeVideoToResolutionArgs
+}
+
+// buildLadder returns a rendition for every option from the highest one that
+// fits the source down to the smallest, oriented like the source.
+func buildLadder(dir string, profile *ve.EncodeProfile, info *ve.VideoInfo, hdr *ve.HDRMetadata) []*rendition {
+	displayWidth, displayHeight := info.DisplaySize()
+
+	options := ve.VideoEncodeOptions[ve.GetEncodingStartIndex(displayWidth, displayHeight):]
+
+	// Every rendition is cut on the same keyframes so players can switch
+	// between them at segment boundaries.
+	segmentTime := options[0].SegmentTime
+
+	renditions := []*rendition{}
+	for _, opt := range options {
+		width, height := ve.OrientedResolution(&opt, displayWidth, displayHeight)
+		name := fmt.Sprintf("%dx%d", width, height)
+
+		args := renditionArgs(&opt, profile, info, hdr, width, height)
+		args.ExtraArgs["force_key_frames"] = fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentTime)
+
+		renditions = append(renditions, &rendition{
+			Option: opt,
+			Width:  width,
+			Height: height,
+			Name:   name,
+			Video:  path.Join(dir, fmt.Sprintf("%s.%s", name, opt.Format)),
+			Args:   args,
+		})
+	}
+
+	return renditions
+}
+
+// encodeAndPackage encodes the renditions and packages them into DASH/HLS
+// inside out. Sources are encoded straight into the segments when direct
+// packaging is enabled; chunked encodes and the per rendition mode still go
+// through an intermediate video per rendition. Renditions and packaging that
+// the job manifest records as done are skipped.
+func encodeAndPackage(ctx context.Context, job *checkpoint.Manifest, in string, renditions []*rendition, durationSeconds float64, workDir string, out string) error {
+	c := config.Conf.Encoder
+
+	if job.IsDone(stagePackaged) {
+		logger.Info("Resuming with packaged renditions in %q", out)
+
+		return nil
+	}
+
+	// Segments of an interrupted attempt are dropped so they aren't uploaded.
+	err := os.RemoveAll(out)
+
+	if err == nil {
+		err = os.MkdirAll(out, os.ModePerm)
+	}
+
+	if err != nil {
+		logger.Error("Unable to create directory! %s", out)
+
+		return err
+	}
+
+	manifest := path.Join(out, constant.MPEGDASHManifestFile)
+	chunked := c.ChunkedEncoding && durationSeconds >= c.ChunkedMinDurationSeconds.Seconds()
+
+	if c.DirectPackaging && c.SingleDecode && !chunked {
+		args := []*ve.EncodeVideoToResolutionArgs{}
+		for _, r := range renditions {
+			args = append(args, r.Args)
+		}
+
+		if err := ve.EncodeVideoToDashDirect(ctx, in, manifest, args, dashArgs(renditions)); err != nil {
+			return err
+		}
+
+		return job.Complete(stagePackaged)
+	}
+
+	pending := []*rendition{}
+	for _, r := range renditions {
+		if _, err := os.Stat(r.Video); err == nil && job.IsDone(renditionStage(r)) {
+			logger.Info("Resuming with encoded rendition %q", r.Video)
+			continue
+		}
+
+		pending = append(pending, r)
+	}
+
+	if len(pending) > 0 {
+		if chunked {
+			err = encodeRenditionsInChunks(ctx, in, pending, workDir)
+		} else {
+			err = encodeLadder(ctx, in, renditionOutputs(pending))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range pending {
+		if err := job.Complete(renditionStage(r)); err != nil {
+			return err
+		}
+	}
+
+	videos := []string{}
+	for _, r := range renditions {
+		videos = append(videos, r.Video)
+	}
+
+	if err := ve.EncodeVideoToDash(ctx, videos, manifest, dashArgs(renditions)); err != nil {
+		return err
+	}
+
+	return job.Complete(stagePackaged)
+}
+
+func renditionStage(r *rendition) string {
+	return "encoded:" + r.Name
+}
+
+func dashArgs(renditions []*rendition) *ve.EncodeVideoToDashArgs {
+	return &ve.EncodeVideoToDashArgs{
+		Copy:            "copy",
+		SegmentDuration: renditions[0].Option.SegmentTime,
+		UseTimeline:     1,
+		UseTemplate:     1,
+		HLSPlaylist:     1,
+	}
+}
+
+// encodeLadder encodes all outputs from one decode of the source, or with one
+// ffmpeg process per output when single decode is disabled.
+func encodeLadder(ctx context.Context, in string, outputs []ve.RenditionOutput) error {
+	if config.Conf.Encoder.SingleDecode {
+		return ve.EncodeVideoToResolutions(ctx, in, outputs)
+	}
+
+	for _, o := range outputs {
+		if err := ve.EncodeVideoToResolution(ctx, in, o.Path, o.Args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func renditionOutputs(renditions []*rendition) []ve.RenditionOutput {
+	outputs := []ve.RenditionOutput{}
+	for _, r := range renditions {
+		outputs = append(outputs, ve.RenditionOutput{Path: r.Video, Args: r.Args})
+	}
+
+	return outputs
+}
+
+// renditionArgs builds the encode arguments of one rung of the ladder. HDR
+// sources are tone mapped or kept HDR depending on the profile.
+func renditionArgs(opt *ve.VideoEncodeOption, profile *ve.EncodeProfile, info *ve.VideoInfo, hdr *ve.HDRMetadata, width int, height int) *ve.EncodeVideoToResolutionArgs {
+	displayWidth, displayHeight := info.DisplaySize()
+
+	args := &ve.EncodeVideoToResolutionArgs{
+		VideoCodec:   opt.VideoCodec,
+		VideoBitRate: opt.VideoBitRate,
+		AudioCodec:   opt.AudioCodec,
+		AudioBitRate: opt.AudioBitRate,
+		VideoFilter:  ve.ScaleFilter(displayWidth, displayHeight, width, height, config.Conf.Encoder.PadToResolution),
+		ExtraArgs:    ffmpeglib.KwArgs{},
+	}
+
+	if !info.IsHDR() {
+		return args
+	}
+
+	switch profile.HDRMode {
+	case ve.HDRModePassthrough:
+		args.VideoCodec = profile.HDRVideoCodec
+		args.ExtraArgs = ve.HDRPassthroughArgs(profile.HDRVideoCodec, info, hdr)
+	default:
+		args.VideoFilter = ve.ToneMapFilter() + "," + args.VideoFilter
+	}
+
+	return args
+}
+
+func getEncodeProfile(name string) *ve.EncodeProfile {
+	if name == "" {
+		name = config.Conf.Encoder.Profile
+	}
+
+	if p, ok := ve.GetEncodeProfile(name); ok {
+		return p
+	}
+
+	logger.Warn("Unknown encode profile %q, using %q", name, ve.DefaultProfile)
+
+	p, _ := ve.GetEncodeProfile(ve.DefaultProfile)
+
+	return p
+}
@@ -0,0 +1,40 @@
+package amqphandler
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/prometheus"
+)
+
+// PanicError is a recovered panic. Jobs that panicked fail right away since
+// retrying would most likely panic again.
+type PanicError struct {
+	Value any
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// NewPanicError logs and counts the panic recovered while processing a
+// message of messageType. It must be called from the deferred func that
+// recovered so the stack still shows where the panic happened.
+func NewPanicError(messageType string, v any) *PanicError {
+	e := &PanicError{Value: v, Stack: string(debug.Stack())}
+
+	logger.Error("Recovered panic processing message %q: %v\n%s", messageType, v, e.Stack)
+	prometheus.HandlerPanicsCounter.WithLabelValues(messageType).Inc()
+
+	return e
+}
+
+// recoverPanic turns a panic of the job into a PanicError. It must be
+// deferred directly.
+func recoverPanic(messageType string, err *error) {
+	if v := recover(); v != nil {
+		*err = NewPanicError(messageType, v)
+	}
+}
@@ -0,0 +1,110 @@
+package amqphandler
+
+import (
+	"context"
+	"path"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/outbox"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/workspace"
+)
+
+// ReEncodeVideoMessage asks to encode an already encoded video again, e.g.
+// after the encode options changed.
+type ReEncodeVideoMessage struct {
+	VideoId string `json:"video_id"`
+	Profile string `json:"profile"`
+	// Version names the output directory under the video's prefix, so the
+	// current output keeps being served until the catalog switches over.
+	Version   string         `json:"version"`
+	Subtitles []SubtitleFile `json:"subtitles"`
+}
+
+type VideoEncodingUpdatedMessage struct {
+	VideoId           string   `json:"video_id"`
+	Version           string   `json:"version"`
+	Profile           string   `json:"profile"`
+	Path              string   `json:"path"`
+	Height            int      `json:"height"`
+	Width             int      `json:"width"`
+	DurationSeconds   int      `json:"duration"`
+	SubtitleLanguages []string `json:"subtitle_languages"`
+}
+
+// ProcessReEncodeVideoMessage encodes the raw video again into the version's
+// prefix and publishes VideoEncodingUpdated once done. Re-encodes of a video
+// that was cancelled are dropped.
+func ProcessReEncodeVideoMessage(ctx context.Context, data *ReEncodeVideoMessage) error {
+	return processEncode(ctx, &encodeJob{
+		data: &VideoUploadedMessage{
+			VideoId:   data.VideoId,
+			Profile:   data.Profile,
+			Subtitles: data.Subtitles,
+		},
+		version: data.Version,
+	})
+}
+
+// encodeJob is an upload or a re-encode of a video.
+type encodeJob struct {
+	data *VideoUploadedMessage
+	// version is empty for uploads, whose output goes right under the
+	// video's prefix.
+	version string
+	// submitted is set for jobs submitted through the API, no message
+	// redelivers them after a failure.
+	submitted bool
+}
+
+func (j *encodeJob) isReEncode() bool {
+	return j.version != ""
+}
+
+func (j *encodeJob) messageType() string {
+	if j.isReEncode() {
+		return constant.MessageTypeReEncodeVideo
+	}
+
+	return constant.MessageTypeEncodeUploadedVideo
+}
+
+func (j *encodeJob) outputPrefix() string {
+	return path.Join(constant.S3EncodedVideosDirectory, j.data.VideoId, j.version)
+}
+
+// jobId keys the job's record and names its workspace directory, a re-encode
+// gets its own so it never resumes from the stages of another version.
+func (j *encodeJob) jobId() string {
+	return jobstore.JobId(j.data.VideoId, j.version)
+}
+
+// publishCompletion adds the event of the finished job to the outbox.
+func (j *encodeJob) publishCompletion(ctx context.Context, marker *completionMarker) error {
+	if j.isReEncode() {
+		return outbox.Add(ctx, constant.MessageTypeVideoEncodingUpdated, marker.Update)
+	}
+
+	return publishEncodingCompleted(ctx, marker.Message)
+}
+
+// cleanupCancelledReEncode deletes the partial output of the version only,
+// the current output of the video stays.
+func cleanupCancelledReEncode(j *encodeJob) error {
+	keys, err := aws.ListS3Objects(j.outputPrefix() + "/")
+	if err != nil {
+		return err
+	}
+
+	if err := aws.DeleteS3Objects(keys); err != nil {
+		return err
+	}
+
+	logger.Info("Deleted %d objects of cancelled re-encode %s of video %s", len(keys), j.version, j.data.VideoId)
+
+	workspace.Remove(j.jobId())
+
+	return nil
+}
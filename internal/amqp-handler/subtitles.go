@@ -0,0 +1,239 @@
+package amqphandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/checkpoint"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/manifest"
+	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+)
+
+const maxSidecarSubtitleBytes = 10 << 20
+
+var (
+	languageTagRegex = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	srtCounterRegex  = regexp.MustCompile(`^\d+$`)
+)
+
+// processSubtitles extracts the embedded and sidecar subtitles into the
+// package directory and adds them to its manifests once per job.
+func processSubtitles(ctx context.Context, job *checkpoint.Manifest, files []SubtitleFile, sourcePath string, sourceInfo *ve.VideoInfo, downloadDir string, packageDir string, durationSeconds float64) ([]manifest.TextTrack, error) {
+	tracks := []manifest.TextTrack{}
+	if job.Data(stageSubtitles, &tracks) {
+		return tracks, nil
+	}
+
+	tracks, err := extractSubtitles(ctx, sourcePath, packageDir, sourceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecarTracks, err := processSidecarSubtitles(ctx, files, downloadDir, packageDir, tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks = append(tracks, sidecarTracks...)
+
+	if err := addTextTracksToManifests(packageDir, tracks, durationSeconds); err != nil {
+		return nil, err
+	}
+
+	return tracks, job.CompleteWithData(stageSubtitles, tracks)
+}
+
+// extractSubtitles converts every embedded text subtitle stream and any
+// CEA-608 captions of the source to WebVTT files inside outDir.
+func extractSubtitles(ctx context.Context, videoPath string, outDir string, info *ve.VideoInfo) ([]manifest.TextTrack, error) {
+	streams, err := ve.GetSubtitleStreams(videoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := []manifest.TextTrack{}
+	names := map[string]int{}
+
+	for _, s := range streams {
+		t := newTextTrack(s.Tags.Language, s.Tags.Title, names)
+
+		if err := ve.ExtractSubtitleToWebVTT(ctx, videoPath, path.Join(outDir, t.File), s.Index); err != nil {
+			return nil, err
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	if info.ClosedCaptions == 1 {
+		t := newTextTrack("", "Closed Captions", names)
+
+		if err := ve.ExtractClosedCaptionsToWebVTT(ctx, videoPath, path.Join(outDir, t.File)); err != nil {
+			return nil, err
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	logger.Info("Extracted %d subtitle tracks from %q", len(tracks), videoPath)
+
+	return tracks, nil
+}
+
+// processSidecarSubtitles downloads the SRT/WebVTT files referenced by the
+// message and converts them to WebVTT inside outDir. Files that fail
+// validation are skipped so a bad sidecar doesn't block the encode.
+func processSidecarSubtitles(ctx context.Context, files []SubtitleFile, downloadDir string, outDir string, existing []manifest.TextTrack) ([]manifest.TextTrack, error) {
+	tracks := []manifest.TextTrack{}
+	names := map[string]int{}
+
+	for _, t := range existing {
+		names[t.Language]++
+	}
+
+	for i, f := range files {
+		if f.ObjectKey == "" || !languageTagRegex.MatchString(f.Language) {
+			logger.Warn("Skipping sidecar subtitle %d with invalid object key %q or language %q", i, f.ObjectKey, f.Language)
+			continue
+		}
+
+		// HEAD first so an oversized file is never downloaded into memory.
+		res, err := aws.HeadS3Object(f.ObjectKey)
+		if aws.IsNotFound(err) {
+			logger.Warn("Skipping sidecar subtitle %q, object not found", f.ObjectKey)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if res.ContentLength != nil && *res.ContentLength > maxSidecarSubtitleBytes {
+			logger.Warn("Skipping sidecar subtitle %q, file is larger than %d bytes", f.ObjectKey, maxSidecarSubtitleBytes)
+			continue
+		}
+
+		p := path.Join(downloadDir, fmt.Sprintf("sidecar_%d%s", i, strings.ToLower(path.Ext(f.ObjectKey))))
+
+		if err := aws.DownloadS3Object(ctx, f.ObjectKey, p); err != nil {
+			return nil, err
+		}
+
+		if err := validateSubtitleFile(p); err != nil {
+			logger.Warn("Skipping sidecar subtitle %q: %v", f.ObjectKey, err)
+			continue
+		}
+
+		t := newTextTrack(f.Language, f.Name, names)
+
+		if err := ve.ExtractSubtitleToWebVTT(ctx, p, path.Join(outDir, t.File), 0); err != nil {
+			logger.Warn("Skipping sidecar subtitle %q, conversion to WebVTT failed: %v", f.ObjectKey, err)
+			names[t.Language]--
+			continue
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	return tracks, nil
+}
+
+// validateSubtitleFile checks that the file is a UTF-8 WebVTT or SRT document.
+func validateSubtitleFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(io.LimitReader(f, maxSidecarSubtitleBytes+1))
+	if err != nil {
+		return err
+	}
+
+	if len(b) > maxSidecarSubtitleBytes {
+		return fmt.Errorf("file is larger than %d bytes", maxSidecarSubtitleBytes)
+	}
+
+	if !utf8.Valid(b) {
+		return errors.New("file is not valid UTF-8")
+	}
+
+	text := strings.TrimPrefix(string(b), "\ufeff")
+	text = strings.TrimLeft(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	if strings.HasPrefix(text, "WEBVTT") {
+		return nil
+	}
+
+	// SRT cues start with a numeric counter followed by a timing line.
+	lines := strings.SplitN(text, "\n", 3)
+	if len(lines) >= 2 && srtCounterRegex.MatchString(strings.TrimSpace(lines[0])) && strings.Contains(lines[1], "-->") {
+		return nil
+	}
+
+	return errors.New("file is neither WebVTT nor SRT")
+}
+
+func addTextTracksToManifests(dir string, tracks []manifest.TextTrack, durationSeconds float64) error {
+	if err := manifest.AddDashTextTracks(path.Join(dir, constant.MPEGDASHManifestFile), tracks); err != nil {
+		return err
+	}
+
+	if err := manifest.AddHLSSubtitleTracks(path.Join(dir, constant.HLSManifestFile), tracks, durationSeconds); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newTextTrack names the WebVTT file of a track after its language. Languages
+// of embedded streams come from the uploaded file, so anything that isn't a
+// language tag is replaced by the default one.
+func newTextTrack(language string, name string, names map[string]int) manifest.TextTrack {
+	if language != "" && !languageTagRegex.MatchString(language) {
+		logger.Warn("Ignoring invalid subtitle language %q", language)
+
+		language = ""
+	}
+
+	if language == "" {
+		language = constant.DefaultSubtitleLanguage
+	}
+
+	if name == "" {
+		name = language
+	}
+
+	names[language]++
+
+	file := fmt.Sprintf("%s_%s.vtt", constant.SubtitleFilePrefix, language)
+	if n := names[language]; n > 1 {
+		file = fmt.Sprintf("%s_%s_%d.vtt", constant.SubtitleFilePrefix, language, n)
+	}
+
+	return manifest.TextTrack{Language: language, Name: name, File: file}
+}
+
+func textTrackLanguages(tracks []manifest.TextTrack) []string {
+	languages := []string{}
+	seen := map[string]bool{}
+
+	for _, t := range tracks {
+		if !seen[t.Language] {
+			seen[t.Language] = true
+			languages = append(languages, t.Language)
+		}
+	}
+
+	return languages
+}
@@ -0,0 +1,106 @@
+package amqphandler
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+)
+
+// ErrInvalidMessage is wrapped by the errors of messages that can never be
+// processed, so they're rejected instead of retried.
+var ErrInvalidMessage = errors.New("invalid message")
+
+func (m *VideoUploadedMessage) Validate() error {
+	if err := validateVideoId(m.VideoId); err != nil {
+		return err
+	}
+
+	if err := validateProfile(m.Profile); err != nil {
+		return err
+	}
+
+	return validateSubtitles(m.VideoId, m.Subtitles)
+}
+
+func (m *ReEncodeVideoMessage) Validate() error {
+	if err := validateVideoId(m.VideoId); err != nil {
+		return err
+	}
+
+	if m.Version == "" {
+		return fmt.Errorf("%w: version is required", ErrInvalidMessage)
+	}
+
+	// The version is a directory under the video's prefix and workspace.
+	if strings.HasPrefix(m.Version, ".") || strings.ContainsAny(m.Version, `/\@`) {
+		return fmt.Errorf("%w: version %q is not a valid directory name", ErrInvalidMessage, m.Version)
+	}
+
+	if err := validateProfile(m.Profile); err != nil {
+		return err
+	}
+
+	return validateSubtitles(m.VideoId, m.Subtitles)
+}
+
+func (m *CancelEncodeMessage) Validate() error {
+	return validateVideoId(m.VideoId)
+}
+
+// validateVideoId makes sure the id is a single path segment, since it's
+// joined into S3 keys and workspace paths.
+func validateVideoId(videoId string) error {
+	if videoId == "" {
+		return ErrMissingVideoId
+	}
+
+	if videoId == "." || videoId == ".." || strings.ContainsAny(videoId, `/\`) {
+		return fmt.Errorf("%w: video_id %q is not a valid id", ErrInvalidMessage, videoId)
+	}
+
+	return nil
+}
+
+func validateProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+
+	if _, ok := ve.GetEncodeProfile(profile); !ok {
+		return fmt.Errorf("%w: unknown profile %q", ErrInvalidMessage, profile)
+	}
+
+	return nil
+}
+
+// validateSubtitles only accepts sidecar files uploaded with the video, so a
+// message can't make the service read other objects of the bucket.
+func validateSubtitles(videoId string, subtitles []SubtitleFile) error {
+	prefix := sidecarPrefix(videoId)
+
+	for i, s := range subtitles {
+		if s.ObjectKey == "" {
+			return fmt.Errorf("%w: subtitles[%d].object_key is required", ErrInvalidMessage, i)
+		}
+
+		if !strings.HasPrefix(s.ObjectKey, prefix) || path.Clean(s.ObjectKey) != s.ObjectKey {
+			return fmt.Errorf("%w: subtitles[%d].object_key must be under %q", ErrInvalidMessage, i, prefix)
+		}
+
+		if s.Language == "" {
+			return fmt.Errorf("%w: subtitles[%d].language is required", ErrInvalidMessage, i)
+		}
+	}
+
+	return nil
+}
+
+// sidecarPrefix is where the sidecar files of a video are uploaded, next to
+// its raw video.
+func sidecarPrefix(videoId string) string {
+	return path.Join(constant.S3RawVideosDirectory, videoId) + "/"
+}
@@ -1,20 +1,35 @@
 package amqphandler
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
 
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
-	"github.com/sagarmaheshwary/microservices-encode-service/internal/helper"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/aws"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/checkpoint"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
 	"golang.org/x/net/context"
 
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
-	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/publisher"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/outbox"
 	ve "github.com/sagarmaheshwary/microservices-encode-service/internal/lib/video-encoder"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/workspace"
+)
+
+// Stages recorded in the job manifest.
+const (
+	stageDownloaded = "downloaded"
+	stageNormalized = "normalized"
+	stagePackaged   = "packaged"
+	stageSubtitles  = "subtitles"
+	stagePublished  = "published"
 )
 
 type VideoUploadedMessage struct {
@@ -24,29 +39,209 @@ type VideoUploadedMessage struct {
 	Description string `json:"description"`
 	PublishedAt string `json:"published_at"`
 	UserId      int    `json:"user_id"`
+	// Profile optionally overrides the configured encode profile.
+	Profile string `json:"profile"`
+	// Subtitles are optional SRT or WebVTT sidecar files uploaded with the video.
+	Subtitles []SubtitleFile `json:"subtitles"`
+}
+
+type SubtitleFile struct {
+	// ObjectKey must be under raw-videos/<video id>/.
+	ObjectKey string `json:"object_key"`
+	Language  string `json:"language"`
+	Name      string `json:"name"`
 }
 
 type VideoEncodingCompletedMessage struct {
-	Title           string `json:"title"`
-	Description     string `json:"description"`
-	PublishedAt     string `json:"published_at"`
-	Height          int    `json:"height"`
-	Width           int    `json:"width"`
-	DurationSeconds int    `json:"duration"`
-	UserId          int    `json:"user_id"`
-	OriginalId      string `json:"original_id"`
-	Thumbnail       string `json:"thumbnail"`
-	Path            string `json:"path"`
+	Title             string   `json:"title"`
+	Description       string   `json:"description"`
+	PublishedAt       string   `json:"published_at"`
+	Height            int      `json:"height"`
+	Width             int      `json:"width"`
+	DurationSeconds   int      `json:"duration"`
+	UserId            int      `json:"user_id"`
+	OriginalId        string   `json:"original_id"`
+	Thumbnail         string   `json:"thumbnail"`
+	Path              string   `json:"path"`
+	SubtitleLanguages []string `json:"subtitle_languages"`
 }
 
 func ProcessVideoUploadedMessage(ctx context.Context, data *VideoUploadedMessage) error {
-	var err error
+	return processEncode(ctx, &encodeJob{data: data})
+}
+
+// ProcessSubmittedJob encodes a video submitted through the API. Nothing
+// retries such a job, so it fails for good on its first failed attempt.
+func ProcessSubmittedJob(ctx context.Context, data *VideoUploadedMessage) error {
+	return processEncode(ctx, &encodeJob{data: data, submitted: true})
+}
 
-	videoDirPath := path.Join(helper.GetRootDir(), "..", constant.TempVideosDownloadDirectory, data.VideoId)
+func processEncode(ctx context.Context, j *encodeJob) (err error) {
+	defer recoverPanic(j.messageType(), &err)
+
+	data := j.data
 
 	objectKey := fmt.Sprintf("%s/%s", constant.S3RawVideosDirectory, data.VideoId)
 
-	videoPath, err := downloadFileFromS3(objectKey, videoDirPath)
+	ctx, release, err := acquireVideo(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	sourceETag, sourceSize, err := headSource(objectKey)
+
+	if aws.IsNotFound(err) {
+		return failMissingSource(ctx, j, objectKey)
+	}
+
+	if err != nil {
+		logger.Error("headSource failed! %v", err)
+
+		return err
+	}
+
+	marker, err := getCompletionMarker(j.outputPrefix())
+
+	if err != nil {
+		logger.Error("getCompletionMarker failed! %v", err)
+
+		return err
+	}
+
+	if marker != nil && marker.SourceETag == sourceETag {
+		logger.Info("Video %s was already encoded into %q at %v, re-publishing completion", data.VideoId, j.outputPrefix(), marker.CompletedAt)
+
+		if err := j.publishCompletion(ctx, marker); err != nil {
+			return err
+		}
+
+		workspace.Remove(j.jobId())
+
+		return nil
+	}
+
+	cancelled, err := isCancelled(data.VideoId, sourceETag)
+
+	if err != nil {
+		return err
+	}
+
+	if cancelled {
+		logger.Info("Video %s was cancelled, dropping message", data.VideoId)
+
+		if j.isReEncode() {
+			return context.Canceled
+		}
+
+		if err := cleanupCancelledJob(ctx, data.VideoId); err != nil {
+			return err
+		}
+
+		return context.Canceled
+	}
+
+	ws := config.Conf.Workspace
+
+	err = workspace.EnsureSpace(uint64(float64(sourceSize)*ws.DiskSpaceMultiplier) + ws.MinFreeDiskSpaceBytes)
+
+	if err != nil {
+		logger.Warn("Not accepting video %s: %v", data.VideoId, err)
+
+		return err
+	}
+
+	releaseLease, err := acquireLease(data.VideoId, sourceETag)
+
+	if err != nil {
+		return err
+	}
+
+	defer releaseLease()
+
+	defer func() {
+		if !errors.Is(err, context.Canceled) {
+			return
+		}
+
+		// Only a requested cancellation deletes the output, not e.g. a
+		// context that ended with its request.
+		cancelled, cancelledErr := isCancelled(data.VideoId, sourceETag)
+		if cancelledErr != nil || !cancelled {
+			logger.Warn("Job of video %s stopped without being cancelled, keeping its output", data.VideoId)
+
+			return
+		}
+
+		if j.isReEncode() {
+			if cleanupErr := cleanupCancelledReEncode(j); cleanupErr != nil {
+				logger.Error("Cleanup of cancelled re-encode of video %s failed! %v", data.VideoId, cleanupErr)
+			}
+
+			return
+		}
+
+		// ctx is done by now, the cleanup runs on its own.
+		if cleanupErr := cleanupCancelledJob(context.Background(), data.VideoId); cleanupErr != nil {
+			logger.Error("Cleanup of cancelled video %s failed! %v", data.VideoId, cleanupErr)
+		}
+	}()
+
+	record := startJobRecord(ctx, data, j.version)
+	record.noRetry = j.submitted
+
+	// Runs after finish, the workspace is only kept for a retry to resume
+	// from.
+	defer func() {
+		if record.status != jobstore.StatusRetrying {
+			workspace.Remove(j.jobId())
+		}
+	}()
+
+	defer func() {
+		err = record.finish(err)
+	}()
+
+	// Runs before finish so a panic is recorded as the job's failure.
+	defer recoverPanic(j.messageType(), &err)
+
+	// The workspace of an earlier upload of the video holds files of the old
+	// source, which must neither be resumed from nor uploaded.
+	if checkpoint.SourceChanged(path.Join(workspace.JobDir(j.jobId()), constant.JobManifestFile), sourceETag) {
+		logger.Info("Raw video %s was uploaded again, removing its workspace", data.VideoId)
+
+		workspace.Remove(j.jobId())
+	}
+
+	videoDirPath, err := workspace.Create(j.jobId())
+
+	if err != nil {
+		return err
+	}
+
+	job, err := checkpoint.Load(path.Join(videoDirPath, constant.JobManifestFile), j.jobId(), sourceETag)
+
+	if err != nil {
+		return err
+	}
+
+	endStage, err := record.begin("download")
+
+	if err != nil {
+		return err
+	}
+
+	videoPath, err := downloadSource(ctx, job, objectKey, videoDirPath)
+
+	endStage(err)
+
+	if err != nil {
+		return err
+	}
+
+	endStage, err = record.begin("probe")
 
 	if err != nil {
 		return err
@@ -54,40 +249,103 @@ func ProcessVideoUploadedMessage(ctx context.Context, data *VideoUploadedMessage
 
 	info, err := ve.GetVideoInfo(videoPath)
 
+	endStage(err)
+
 	if err != nil {
 		logger.Error("ve.GetVideoInfo failed! %v", err)
 
 		return err
 	}
 
-	encodeFrom := ve.GetEncodingStartIndex(info.Width, info.Height)
+	sourcePath, sourceInfo := videoPath, info
 
-	opt := ve.VideoEncodeOptions[encodeFrom]
+	profile := getEncodeProfile(data.Profile)
 
-	filePrefix := fmt.Sprintf("%dx%d", opt.Width, opt.Height)
+	record.metadata(info, profile.Name)
 
-	chunkDirectory := path.Join(videoDirPath, filePrefix)
-	encodedVideo := path.Join(videoDirPath, fmt.Sprintf("%s.%s", filePrefix, opt.Format))
+	if config.Conf.Encoder.NormalizeSource {
+		endStage, err = record.begin("normalize")
 
-	err = encodeVideoToResolution(videoPath, encodedVideo, &opt)
+		if err != nil {
+			return err
+		}
+
+		videoPath, info, err = normalizeVideo(ctx, job, videoPath, videoDirPath, info)
+
+		endStage(err)
+
+		if err != nil {
+			logger.Error("normalizeVideo failed! %v", err)
+
+			return err
+		}
+	}
+
+	var hdr *ve.HDRMetadata
+
+	if info.IsHDR() {
+		hdr, err = ve.GetHDRMetadata(videoPath)
+
+		if err != nil {
+			logger.Error("ve.GetHDRMetadata failed! %v", err)
+
+			return err
+		}
+
+		logger.Info("HDR source %q (%s), profile %q uses %s", videoPath, info.ColorTransfer, profile.Name, profile.HDRMode)
+	}
+
+	displayWidth, displayHeight := info.DisplaySize()
+
+	renditions := buildLadder(videoDirPath, profile, info, hdr)
+
+	packageDirectory := path.Join(videoDirPath, constant.PackageDirectory)
+
+	duration, _ := strconv.ParseFloat(info.Duration, strconv.IntSize)
+
+	endStage, err = record.begin("package")
 
 	if err != nil {
-		logger.Error("encodeVideoToResolution failed! %v", err)
+		return err
+	}
+
+	err = encodeAndPackage(ctx, job, videoPath, renditions, duration, videoDirPath, packageDirectory)
+
+	endStage(err)
+
+	if err != nil {
+		logger.Error("encodeAndPackage failed! %v", err)
 
 		return err
 	}
 
-	err = encodeVideoToDash(encodedVideo, chunkDirectory, &opt)
+	endStage, err = record.begin("subtitles")
 
 	if err != nil {
-		logger.Error("encodeVideoToDash failed! %v", err)
+		return err
+	}
 
+	tracks, err := processSubtitles(ctx, job, data.Subtitles, sourcePath, sourceInfo, videoDirPath, packageDirectory, duration)
+
+	endStage(err)
+
+	if err != nil {
+		logger.Error("processSubtitles failed! %v", err)
+
+		return err
+	}
+
+	uploadPrefix := j.outputPrefix()
+
+	endStage, err = record.begin("upload")
+
+	if err != nil {
 		return err
 	}
 
-	uploadPrefix := path.Join(constant.S3EncodedVideosDirectory, data.VideoId, filePrefix)
+	err = uploadChunksToS3(ctx, job, uploadPrefix, packageDirectory)
 
-	err = uploadChunksToS3(uploadPrefix, chunkDirectory)
+	endStage(err)
 
 	if err != nil {
 		logger.Error("uploadChunksToS3 failed! %v", err)
@@ -95,79 +353,175 @@ func ProcessVideoUploadedMessage(ctx context.Context, data *VideoUploadedMessage
 		return err
 	}
 
-	logger.Info("Processed chunks for %s", chunkDirectory)
+	logger.Info("Processed %d renditions in %s", len(renditions), packageDirectory)
+
+	renditionNames := []string{}
+	for _, r := range renditions {
+		renditionNames = append(renditionNames, r.Name)
+	}
+
+	record.outputs(&jobstore.Outputs{
+		Prefix:            uploadPrefix,
+		Renditions:        renditionNames,
+		SubtitleLanguages: textTrackLanguages(tracks),
+	})
 
 	logger.Info("Video encoding %s completed", data.VideoId)
 
-	duration, _ := strconv.ParseFloat(info.Duration, strconv.IntSize)
+	marker = &completionMarker{
+		SourceETag:  sourceETag,
+		CompletedAt: time.Now(),
+	}
 
-	err = publisher.P.Publish(ctx, constant.QueueVideoCatalogService, &publisher.MessageType{
-		Key: constant.MessageTypeVideoEncodingCompleted,
-		Data: &VideoEncodingCompletedMessage{
-			Title:           data.Title,
-			Description:     data.Description,
-			Height:          info.Height,
-			Width:           info.Width,
-			DurationSeconds: int(duration),
-			UserId:          data.UserId,
-			OriginalId:      data.VideoId,
-			Thumbnail:       fmt.Sprintf("%s/%s", constant.S3ThumbnailsDirectory, data.ThumbnailId),
-			PublishedAt:     data.PublishedAt,
-			Path:            uploadPrefix,
-		},
-	})
+	if j.isReEncode() {
+		marker.Update = &VideoEncodingUpdatedMessage{
+			VideoId:           data.VideoId,
+			Version:           j.version,
+			Profile:           profile.Name,
+			Path:              uploadPrefix,
+			Height:            displayHeight,
+			Width:             displayWidth,
+			DurationSeconds:   int(duration),
+			SubtitleLanguages: textTrackLanguages(tracks),
+		}
+	} else {
+		marker.Message = &VideoEncodingCompletedMessage{
+			Title:             data.Title,
+			Description:       data.Description,
+			Height:            displayHeight,
+			Width:             displayWidth,
+			DurationSeconds:   int(duration),
+			UserId:            data.UserId,
+			OriginalId:        data.VideoId,
+			Thumbnail:         fmt.Sprintf("%s/%s", constant.S3ThumbnailsDirectory, data.ThumbnailId),
+			PublishedAt:       data.PublishedAt,
+			Path:              uploadPrefix,
+			SubtitleLanguages: textTrackLanguages(tracks),
+		}
+	}
+
+	err = putCompletionMarker(uploadPrefix, marker)
 
 	if err != nil {
-		logger.Error("Unable to send data to video catalog service! %v", err)
+		logger.Error("putCompletionMarker failed! %v", err)
 
 		return err
 	}
 
-	return nil
-}
+	if job.IsDone(stagePublished) {
+		logger.Info("Completion of video %s was already published", data.VideoId)
 
-func encodeVideoToResolution(in string, out string, opt *ve.VideoEncodeOption) error {
-	err := ve.EncodeVideoToResolution(in, out, &ve.EncodeVideoToResolutionArgs{
-		VideoCodec:   opt.VideoCodec,
-		VideoBitRate: opt.VideoBitRate,
-		AudioCodec:   opt.AudioCodec,
-		AudioBitRate: opt.AudioBitRate,
-		Resolution:   fmt.Sprintf("%d:%d", opt.Width, opt.Height),
-	})
+		return nil
+	}
+
+	endStage, err = record.begin("publish")
 
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = j.publishCompletion(ctx, marker)
 
-func encodeVideoToDash(in string, out string, opt *ve.VideoEncodeOption) error {
-	err := os.Mkdir(out, os.ModePerm)
+	endStage(err)
 
 	if err != nil {
-		logger.Error("Unable to create directory! %s", out)
-
 		return err
 	}
 
-	p := path.Join(out, constant.MPEGDASHManifestFile)
+	return job.Complete(stagePublished)
+}
 
-	err = ve.EncodeVideoToDash(in, p, &ve.EncodeVideoToDashArgs{
-		Copy:            "copy",
-		SegmentDuration: opt.SegmentTime,
-		UseTimeline:     1,
-		UseTemplate:     1,
-	})
+// failMissingSource drops the job of a raw video that doesn't exist. It's
+// recorded as failed unless the video was cancelled, e.g. by deleting it.
+func failMissingSource(ctx context.Context, j *encodeJob, objectKey string) error {
+	// Any cancellation applies, whichever upload it was made for.
+	cancelled, err := getJSONObject(cancellationMarkerKey(j.data.VideoId), new(cancellationMarker))
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if cancelled {
+		logger.Info("Video %s was cancelled, dropping message", j.data.VideoId)
+
+		return context.Canceled
+	}
+
+	logger.Error("Raw video %q not found", objectKey)
+
+	record := startJobRecord(ctx, j.data, j.version)
+
+	return record.finish(fmt.Errorf("%w: %s", ErrSourceNotFound, objectKey))
+}
+
+// publishEncodingCompleted adds the completion to the outbox, whose relay
+// delivers it to the video catalog service even if this process dies first.
+func publishEncodingCompleted(ctx context.Context, message *VideoEncodingCompletedMessage) error {
+	return outbox.Add(ctx, constant.MessageTypeVideoEncodingCompleted, message)
+}
+
+// normalizeVideo re-encodes sources with non-square pixels, odd dimensions or
+// a variable/too high frame rate into a mezzanine file the ladder can use.
+func normalizeVideo(ctx context.Context, job *checkpoint.Manifest, in string, dir string, info *ve.VideoInfo) (string, *ve.VideoInfo, error) {
+	maxFrameRate := config.Conf.Encoder.MaxFrameRate
+
+	var normalized string
+	if job.Data(stageNormalized, &normalized) {
+		if normalized == "" {
+			return in, info, nil
+		}
+
+		if _, err := os.Stat(normalized); err == nil {
+			logger.Info("Resuming with normalized video %q", normalized)
+
+			normalizedInfo, err := ve.GetVideoInfo(normalized)
+			return normalized, normalizedInfo, err
+		}
+	}
+
+	reasons := ve.NormalizationReasons(info, maxFrameRate)
+	if len(reasons) == 0 {
+		return in, info, job.CompleteWithData(stageNormalized, "")
+	}
+
+	logger.Info("Normalizing %q: %s", in, strings.Join(reasons, ", "))
+
+	out := path.Join(dir, constant.NormalizedVideoFile)
+
+	args := &ve.NormalizeVideoArgs{
+		VideoFilter:  ve.NormalizeFilter(info, maxFrameRate),
+		VideoCodec:   "libx264",
+		CRF:          18,
+		Preset:       "veryfast",
+		AudioCodec:   "aac",
+		AudioBitRate: "320k",
+	}
+
+	// HDR sources are normalized to 10-bit HEVC so the ladder still sees the
+	// original color metadata and can tone map or pass it through.
+	if info.IsHDR() {
+		hdr, err := ve.GetHDRMetadata(in)
+		if err != nil {
+			return "", nil, err
+		}
+
+		args.VideoCodec = "libx265"
+		args.ExtraArgs = ve.HDRPassthroughArgs(args.VideoCodec, info, hdr)
+	}
+
+	if err := ve.NormalizeVideo(ctx, in, out, args); err != nil {
+		return "", nil, err
+	}
+
+	normalizedInfo, err := ve.GetVideoInfo(out)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return out, normalizedInfo, job.CompleteWithData(stageNormalized, out)
 }
 
-func uploadChunksToS3(uploadPathPrefix string, chunkDir string) error {
+func uploadChunksToS3(ctx context.Context, job *checkpoint.Manifest, uploadPathPrefix string, chunkDir string) error {
 	files, err := os.ReadDir(chunkDir)
 
 	if err != nil {
@@ -180,34 +534,60 @@ func uploadChunksToS3(uploadPathPrefix string, chunkDir string) error {
 		p := path.Join(chunkDir, f.Name())
 		uploadId := path.Join(uploadPathPrefix, f.Name())
 
+		if job.IsUploaded(uploadId) {
+			continue
+		}
+
 		logger.Info(`Uploading chunk file: \"%s", upload path: "%s" (%d)`, p, uploadId, i+1)
 
-		err := aws.UploadObjectToS3(p, uploadId)
+		err := aws.UploadObjectToS3(ctx, p, uploadId)
 
 		if err != nil {
 			return err //@TODO: retry failed chunks
 		}
+
+		if err := job.MarkUploaded(uploadId); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func downloadFileFromS3(filename string, downloadDirectory string) (string, error) {
-	err := os.Mkdir(downloadDirectory, os.ModePerm)
+// downloadSource downloads the raw video unless a previous attempt already
+// did and the file still matches the recorded checksum.
+func downloadSource(ctx context.Context, job *checkpoint.Manifest, objectKey string, downloadDirectory string) (string, error) {
+	p := path.Join(downloadDirectory, constant.SourceVideoFile)
 
-	if err != nil {
-		logger.Error("Unable to create directory for video %s", downloadDirectory)
+	if job.IsDone(stageDownloaded) {
+		checksum, err := checkpoint.FileChecksum(p)
 
-		return "", err
+		if err == nil && checksum == job.SourceChecksum {
+			logger.Info("Resuming video %s from job manifest", job.VideoId)
+
+			return p, nil
+		}
+
+		logger.Warn("Downloaded source of video %s is missing or changed, starting over", job.VideoId)
 	}
 
-	p := path.Join(downloadDirectory, helper.UniqueString(8))
+	err := aws.DownloadS3Object(ctx, objectKey, p)
 
-	err = aws.DownloadS3Object(filename, p)
+	if err != nil {
+		return "", err
+	}
+
+	checksum, err := checkpoint.FileChecksum(p)
 
 	if err != nil {
+		logger.Error("Unable to compute checksum of %q: %v", p, err)
+
+		return "", err
+	}
+
+	if err := job.Reset(checksum); err != nil {
 		return "", err
 	}
 
-	return p, nil
+	return p, job.Complete(stageDownloaded)
 }
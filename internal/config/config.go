@@ -1,24 +1,45 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofor-little/env"
-	"github.com/sagarmaheshwary/microservices-encode-service/internal/helper"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
 )
 
 var Conf *Config
 
+// defaultBindings route commands to the service's queues and its events to
+// the video catalog service.
+var defaultBindings = strings.Join([]string{
+	constant.QueueEncodeService + "=" + constant.MessageTypeEncodeUploadedVideo,
+	constant.QueueEncodeService + "=" + constant.MessageTypeReEncodeVideo,
+	constant.QueueEncodeServiceControl + "=" + constant.MessageTypeCancelEncode,
+	constant.QueueVideoCatalogService + "=" + constant.MessageTypeVideoEncodingCompleted,
+	constant.QueueVideoCatalogService + "=" + constant.MessageTypeVideoEncodingCancelled,
+	constant.QueueVideoCatalogService + "=" + constant.MessageTypeVideoEncodingFailed,
+	constant.QueueVideoCatalogService + "=" + constant.MessageTypeVideoEncodingUpdated,
+}, ",")
+
 type Config struct {
 	AWS        *AWS
 	AMQP       *AMQP
 	GRPCServer *GRPCServer
 	Prometheus *Prometheus
 	Jaeger     *Jaeger
+	Encoder    *Encoder
+	Job        *Job
+	Workspace  *Workspace
+	Outbox     *Outbox
 }
 
 type GRPCServer struct {
@@ -36,13 +57,51 @@ type AWS struct {
 }
 
 type AMQP struct {
-	Host                           string
-	Port                           int
-	Username                       string
-	Password                       string
+	// URI is a full amqp:// or amqps:// URI used instead of Host, Port,
+	// Username, Password, VHost and TLS when set.
+	URI      string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	VHost    string
+	TLS      bool
+	// TLSCAFile is a PEM bundle of the CAs the broker's certificate is
+	// verified against, the system pool is used when empty. TLSCertFile and
+	// TLSKeyFile are the client certificate, required for EXTERNAL auth.
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+	// AuthMechanism is PLAIN or EXTERNAL, which authenticates with the
+	// client certificate instead of the password.
+	AuthMechanism string
+	// ConnectionName is shown for the connection in the management UI.
+	ConnectionName                 string
 	PublishTimeoutSeconds          time.Duration
+	PublishRetryAttempts           int
+	PublishRetryIntervalSeconds    time.Duration
 	ConnectionRetryIntervalSeconds time.Duration
 	ConnectionRetryAttempts        int
+	// Exchange is the topic exchange events are published to with their
+	// message key as routing key.
+	Exchange     string
+	ExchangeType string
+	// Bindings are comma separated "queue=routing key" pairs bound to
+	// Exchange, including the queues of downstream services.
+	Bindings string
+	// The Queue* settings are the arguments of the consumed queues. RabbitMQ
+	// can't change the arguments of an existing queue, so it has to be
+	// deleted before changing them.
+	QueueType              string
+	QueueMessageTTLSeconds time.Duration
+	QueueMaxLength         int
+	QueueOverflow          string
+	QueueMaxPriority       int
+	DeadLetterExchange     string
+	// PrefetchCount limits the unacked deliveries so higher priority
+	// messages aren't stuck behind ones already sent to this consumer.
+	PrefetchCount int
 }
 
 type Prometheus struct {
@@ -53,18 +112,52 @@ type Jaeger struct {
 	URL string
 }
 
-func Init() {
-	envPath := path.Join(helper.GetRootDir(), "..", ".env")
+type Encoder struct {
+	Profile         string
+	PadToResolution bool
+	SingleDecode    bool
+	DirectPackaging bool
+	NormalizeSource bool
+	MaxFrameRate    float64
+	// Chunked encoding splits sources longer than ChunkedMinDurationSeconds
+	// into ChunkDurationSeconds chunks encoded by ChunkWorkers in parallel.
+	ChunkedEncoding           bool
+	ChunkDurationSeconds      time.Duration
+	ChunkWorkers              int
+	ChunkedMinDurationSeconds time.Duration
+}
 
-	if _, err := os.Stat(envPath); err == nil {
-		if err := env.Load(envPath); err != nil {
-			logger.Fatal("Failed to load .env %q: %v", envPath, err)
-		}
+type Job struct {
+	// LeaseSeconds is how long other replicas treat a video as being encoded
+	// by this one. The lease is renewed while the job runs.
+	LeaseSeconds time.Duration
+	// MaxAttempts is how many times a failing job is retried before its
+	// message is rejected.
+	MaxAttempts int
+	StoreDriver string
+	StorePath   string
+}
 
-		logger.Info("Loaded environment variables from %q", envPath)
-	} else {
-		logger.Info(".env file not found, using system environment variables")
-	}
+type Outbox struct {
+	Path                 string
+	RelayIntervalSeconds time.Duration
+}
+
+type Workspace struct {
+	Dir                   string
+	OrphanMaxAgeSeconds   time.Duration
+	DiskSpaceMultiplier   float64
+	MinFreeDiskSpaceBytes uint64
+}
+
+// Options are the command-line flags that override environment variables.
+type Options struct {
+	EnvFile      string
+	WorkspaceDir string
+}
+
+func Init(opts Options) {
+	loadEnvFile(opts.EnvFile)
 
 	Conf = &Config{
 		GRPCServer: &GRPCServer{
@@ -80,13 +173,33 @@ func Init() {
 			CloudFrontURL:               getEnv("AWS_CLOUDFRONT_URL", ""),
 		},
 		AMQP: &AMQP{
+			URI:                            getEnv("AMQP_URI", ""),
 			Host:                           getEnv("AMQP_HOST", "localhost"),
-			Port:                           getEnvInt("AMQP_PORT", 5672),
 			Username:                       getEnv("AMQP_USERNAME", "guest"),
 			Password:                       getEnv("AMQP_PASSWORD", "guest"),
+			VHost:                          getEnv("AMQP_VHOST", "/"),
+			TLS:                            getEnvBool("AMQP_TLS", false),
+			TLSCAFile:                      getEnv("AMQP_TLS_CA_FILE", ""),
+			TLSCertFile:                    getEnv("AMQP_TLS_CERT_FILE", ""),
+			TLSKeyFile:                     getEnv("AMQP_TLS_KEY_FILE", ""),
+			TLSServerName:                  getEnv("AMQP_TLS_SERVER_NAME", ""),
+			AuthMechanism:                  strings.ToUpper(getEnv("AMQP_AUTH_MECHANISM", constant.AMQPAuthPlain)),
+			ConnectionName:                 getEnv("AMQP_CONNECTION_NAME", defaultConnectionName()),
 			PublishTimeoutSeconds:          getEnvDurationSeconds("AMQP_PUBLISH_TIMEOUT_SECONDS", 5),
+			PublishRetryAttempts:           getEnvInt("AMQP_PUBLISH_RETRY_ATTEMPTS", 5),
+			PublishRetryIntervalSeconds:    getEnvDurationSeconds("AMQP_PUBLISH_RETRY_INTERVAL_SECONDS", 1),
 			ConnectionRetryIntervalSeconds: getEnvDurationSeconds("AMQP_CONNECTION_RETRY_INTERVAL_SECONDS", 5),
 			ConnectionRetryAttempts:        getEnvInt("AMQP_CONNECTION_RETRY_ATTEMPTS", 10),
+			Exchange:                       getEnv("AMQP_EXCHANGE", "EncodeService.events"),
+			ExchangeType:                   getEnv("AMQP_EXCHANGE_TYPE", "topic"),
+			Bindings:                       getEnv("AMQP_BINDINGS", defaultBindings),
+			QueueType:                      getEnv("AMQP_QUEUE_TYPE", "classic"),
+			QueueMessageTTLSeconds:         getEnvDurationSeconds("AMQP_QUEUE_MESSAGE_TTL_SECONDS", 0),
+			QueueMaxLength:                 getEnvInt("AMQP_QUEUE_MAX_LENGTH", 0),
+			QueueOverflow:                  getEnv("AMQP_QUEUE_OVERFLOW", ""),
+			QueueMaxPriority:               getEnvInt("AMQP_QUEUE_MAX_PRIORITY", 0),
+			DeadLetterExchange:             getEnv("AMQP_DEAD_LETTER_EXCHANGE", ""),
+			PrefetchCount:                  getEnvInt("AMQP_PREFETCH_COUNT", 1),
 		},
 		Prometheus: &Prometheus{
 			URL: getEnv("PROMETHEUS_URL", "localhost:5014"),
@@ -94,9 +207,191 @@ func Init() {
 		Jaeger: &Jaeger{
 			URL: getEnv("JAEGER_URL", "localhost:4318"),
 		},
+		Encoder: &Encoder{
+			Profile:         getEnv("ENCODER_PROFILE", "default"),
+			PadToResolution: getEnvBool("ENCODER_PAD_TO_RESOLUTION", false),
+			SingleDecode:    getEnvBool("ENCODER_SINGLE_DECODE", true),
+			DirectPackaging: getEnvBool("ENCODER_DIRECT_PACKAGING", true),
+			NormalizeSource: getEnvBool("ENCODER_NORMALIZE_SOURCE", true),
+			MaxFrameRate:    getEnvFloat("ENCODER_MAX_FRAME_RATE", 60),
+
+			ChunkedEncoding:           getEnvBool("ENCODER_CHUNKED_ENCODING", false),
+			ChunkDurationSeconds:      getEnvDurationSeconds("ENCODER_CHUNK_DURATION_SECONDS", 60),
+			ChunkWorkers:              getEnvInt("ENCODER_CHUNK_WORKERS", runtime.NumCPU()),
+			ChunkedMinDurationSeconds: getEnvDurationSeconds("ENCODER_CHUNKED_MIN_DURATION_SECONDS", 300),
+		},
+		Job: &Job{
+			LeaseSeconds: getEnvDurationSeconds("JOB_LEASE_SECONDS", 600),
+			MaxAttempts:  getEnvInt("JOB_MAX_ATTEMPTS", 3),
+			StoreDriver:  getEnv("JOB_STORE_DRIVER", "bolt"),
+		},
+		Workspace: &Workspace{
+			Dir:                   workspaceDir(opts.WorkspaceDir),
+			OrphanMaxAgeSeconds:   getEnvDurationSeconds("WORKSPACE_ORPHAN_MAX_AGE_SECONDS", 86400), //24 hours
+			DiskSpaceMultiplier:   getEnvFloat("WORKSPACE_DISK_SPACE_MULTIPLIER", 4),
+			MinFreeDiskSpaceBytes: uint64(getEnvInt("WORKSPACE_MIN_FREE_DISK_SPACE_MB", 512)) << 20,
+		},
+		Outbox: &Outbox{
+			RelayIntervalSeconds: getEnvDurationSeconds("OUTBOX_RELAY_INTERVAL_SECONDS", 5),
+		},
+	}
+
+	// The job store and outbox live next to the workspace by default so they
+	// aren't mistaken for job directories.
+	Conf.Job.StorePath = getEnv("JOB_STORE_PATH", path.Join(path.Dir(Conf.Workspace.Dir), constant.JobStoreFile))
+	Conf.Outbox.Path = getEnv("OUTBOX_PATH", path.Join(path.Dir(Conf.Workspace.Dir), constant.OutboxFile))
+
+	// RabbitMQ listens for TLS connections on a port of its own.
+	amqpPort := 5672
+	if Conf.AMQP.TLS {
+		amqpPort = 5671
+	}
+
+	Conf.AMQP.Port = getEnvInt("AMQP_PORT", amqpPort)
+
+	if err := validateAMQP(Conf.AMQP); err != nil {
+		logger.Fatal("Invalid AMQP config: %v", err)
+	}
+
+	if Conf.Encoder.ChunkWorkers < 1 {
+		logger.Fatal("ENCODER_CHUNK_WORKERS must be at least 1, got %d", Conf.Encoder.ChunkWorkers)
+	}
+
+	if err := validateWritableDir(Conf.Workspace.Dir); err != nil {
+		logger.Fatal("Workspace directory %q is not writable: %v", Conf.Workspace.Dir, err)
+	}
+
+	if err := validateWritableDir(path.Dir(Conf.Job.StorePath)); err != nil {
+		logger.Fatal("Job store directory %q is not writable: %v", path.Dir(Conf.Job.StorePath), err)
+	}
+
+	if err := validateWritableDir(path.Dir(Conf.Outbox.Path)); err != nil {
+		logger.Fatal("Outbox directory %q is not writable: %v", path.Dir(Conf.Outbox.Path), err)
 	}
 }
 
+// loadEnvFile loads the file given by the flag or ENV_FILE, falling back to
+// .env in the working directory and then the user config directory. Only an
+// explicitly given file is required to exist.
+func loadEnvFile(flagPath string) {
+	envPath := flagPath
+	if envPath == "" {
+		envPath = os.Getenv("ENV_FILE")
+	}
+
+	if envPath == "" {
+		for _, p := range defaultEnvFiles() {
+			if _, err := os.Stat(p); err == nil {
+				envPath = p
+				break
+			}
+		}
+	}
+
+	if envPath == "" {
+		logger.Info(".env file not found, using system environment variables")
+		return
+	}
+
+	if err := env.Load(envPath); err != nil {
+		logger.Fatal("Failed to load .env %q: %v", envPath, err)
+	}
+
+	logger.Info("Loaded environment variables from %q", envPath)
+}
+
+func defaultEnvFiles() []string {
+	files := []string{".env"}
+
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, path.Join(dir, constant.AppDirectory, ".env"))
+	}
+
+	return files
+}
+
+// workspaceDir returns the flag, WORKSPACE_DIR or the user cache directory
+// ($XDG_CACHE_HOME on Linux), in that order.
+func workspaceDir(flagDir string) string {
+	if flagDir != "" {
+		return flagDir
+	}
+
+	if dir := os.Getenv("WORKSPACE_DIR"); dir != "" {
+		return dir
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return path.Join(dir, constant.AppDirectory, constant.TempVideosDownloadDirectory)
+}
+
+func validateAMQP(c *AMQP) error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("AMQP_TLS_CERT_FILE and AMQP_TLS_KEY_FILE must be set together")
+	}
+
+	switch c.AuthMechanism {
+	case constant.AMQPAuthPlain:
+	case constant.AMQPAuthExternal:
+		if !c.usesTLS() || c.TLSCertFile == "" {
+			return errors.New("EXTERNAL auth requires TLS with a client certificate")
+		}
+	default:
+		return fmt.Errorf("unsupported auth mechanism %q", c.AuthMechanism)
+	}
+
+	return nil
+}
+
+// usesTLS reports whether the connection is made over TLS, which the scheme
+// of URI tells when it's set.
+func (c *AMQP) usesTLS() bool {
+	if c.URI != "" {
+		u, err := url.Parse(c.URI)
+		return err == nil && u.Scheme == constant.ProtocolAMQPS
+	}
+
+	return c.TLS
+}
+
+// defaultConnectionName tells the replicas apart in the management UI.
+func defaultConnectionName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return constant.ServiceName
+	}
+
+	return fmt.Sprintf("%s (%s)", constant.ServiceName, hostname)
+}
+
+// validateWritableDir creates dir when needed and checks a file can be
+// written to it.
+func validateWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(f.Close(), os.Remove(f.Name()))
+}
+
 func getEnv(key string, defaultVal string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -113,6 +408,22 @@ func getEnvInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+func getEnvFloat(key string, defaultVal float64) float64 {
+	if val, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return val
+	}
+
+	return defaultVal
+}
+
+func getEnvBool(key string, defaultVal bool) bool {
+	if val, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return val
+	}
+
+	return defaultVal
+}
+
 func getEnvDurationSeconds(key string, defaultVal time.Duration) time.Duration {
 	if val, err := strconv.Atoi(os.Getenv(key)); err == nil {
 		return time.Duration(val) * time.Second
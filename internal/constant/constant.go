@@ -1,22 +1,38 @@
 package constant
 
 const (
-	QueueEncodeService       = "EncodeService"
-	QueueVideoCatalogService = "VideoCatalogService"
+	QueueEncodeService        = "EncodeService"
+	QueueEncodeServiceControl = "EncodeService.control"
+	QueueVideoCatalogService  = "VideoCatalogService"
 )
 
 const (
 	MessageTypeEncodeUploadedVideo    = "EncodeUploadedVideo"
+	MessageTypeCancelEncode           = "CancelEncode"
 	MessageTypeVideoEncodingCompleted = "VideoEncodingCompleted"
+	MessageTypeVideoEncodingCancelled = "VideoEncodingCancelled"
+	MessageTypeVideoEncodingFailed    = "VideoEncodingFailed"
+	MessageTypeReEncodeVideo          = "ReEncodeVideo"
+	MessageTypeVideoEncodingUpdated   = "VideoEncodingUpdated"
 )
 
+// MessageSchemaVersion is the envelope version this service publishes and the
+// newest one it consumes.
+const MessageSchemaVersion = 1
+
 const (
 	ContentTypeJSON = "application/json"
 )
 
 const (
-	ProtocolTCP  = "tcp"
-	ProtocolAMQP = "amqp"
+	ProtocolTCP   = "tcp"
+	ProtocolAMQP  = "amqp"
+	ProtocolAMQPS = "amqps"
+)
+
+const (
+	AMQPAuthPlain    = "PLAIN"
+	AMQPAuthExternal = "EXTERNAL"
 )
 
 const (
@@ -25,9 +41,44 @@ const (
 	S3ThumbnailsDirectory    = "thumbnails"
 )
 
+// AppDirectory is the directory name used under the user config and cache
+// directories.
+const AppDirectory = "encode-service"
+
 const TempVideosDownloadDirectory = "videos"
 
-const MPEGDASHManifestFile = "master.mpd"
+const (
+	JobStoreFile = "jobs.db"
+	OutboxFile   = "outbox.db"
+)
+
+const (
+	SourceVideoFile     = "source"
+	NormalizedVideoFile = "normalized.mp4"
+	JobManifestFile     = "job.json"
+)
+
+const (
+	ChunksDirectory  = "chunks"
+	PackageDirectory = "package"
+)
+
+// Objects stored next to the encoded output of a video.
+const (
+	CompletionMarkerFile   = ".complete.json"
+	ProcessingLeaseFile    = ".lease.json"
+	CancellationMarkerFile = ".cancelled.json"
+)
+
+const (
+	MPEGDASHManifestFile = "master.mpd"
+	HLSManifestFile      = "master.m3u8"
+)
+
+const (
+	SubtitleFilePrefix      = "subtitle"
+	DefaultSubtitleLanguage = "und"
+)
 
 const ServiceName = "Encode Service"
 
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	encodepb "github.com/sagarmaheshwary/microservices-encode-service/internal/proto/encode"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type encodeServer struct {
+	encodepb.UnimplementedEncodeServiceServer
+}
+
+func (e *encodeServer) SubmitJob(ctx context.Context, req *encodepb.SubmitJobRequest) (*encodepb.SubmitJobResponse, error) {
+	data := &amqphandler.VideoUploadedMessage{
+		VideoId:     req.VideoId,
+		ThumbnailId: req.ThumbnailId,
+		Title:       req.Title,
+		Description: req.Description,
+		PublishedAt: req.PublishedAt,
+		UserId:      int(req.UserId),
+		Profile:     req.Profile,
+	}
+
+	for _, s := range req.Subtitles {
+		data.Subtitles = append(data.Subtitles, amqphandler.SubtitleFile{
+			ObjectKey: s.ObjectKey,
+			Language:  s.Language,
+			Name:      s.Name,
+		})
+	}
+
+	if err := data.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if amqphandler.IsInProgress(req.VideoId) {
+		return nil, status.Error(codes.AlreadyExists, amqphandler.ErrDuplicateInProgress.Error())
+	}
+
+	if req.Wait {
+		// The job runs to the end even if the caller goes away, only
+		// CancelJob stops it.
+		err := runSubmittedJob(context.WithoutCancel(ctx), data)
+		if err != nil {
+			return nil, submitError(err)
+		}
+
+		return e.submitJobResponse(req.VideoId)
+	}
+
+	var previous jobstore.Job
+
+	_, err := jobstore.S.Update(req.VideoId, func(j *jobstore.Job) {
+		previous = *j
+		j.Status = jobstore.StatusQueued
+		j.Error = ""
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// The job outlives the request but stays in the caller's trace.
+	jobCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+
+	go func() {
+		if err := runSubmittedJob(jobCtx, data); isDuplicate(err) {
+			settleDuplicate(req.VideoId, &previous, err)
+		}
+	}()
+
+	return e.submitJobResponse(req.VideoId)
+}
+
+func (e *encodeServer) submitJobResponse(videoId string) (*encodepb.SubmitJobResponse, error) {
+	j, err := jobstore.S.Get(videoId)
+	if err != nil {
+		return nil, jobError(err)
+	}
+
+	return &encodepb.SubmitJobResponse{Job: toJobProto(j)}, nil
+}
+
+// runSubmittedJob runs the job and settles its record when the job returned
+// before recording anything, e.g. because the video was already encoded.
+func runSubmittedJob(ctx context.Context, data *amqphandler.VideoUploadedMessage) error {
+	err := amqphandler.ProcessSubmittedJob(ctx, data)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("Submitted job of video %s failed: %v", data.VideoId, err)
+	}
+
+	if isDuplicate(err) {
+		return err
+	}
+
+	jobstore.S.Update(data.VideoId, func(j *jobstore.Job) {
+		if j.Status != jobstore.StatusQueued && j.Status != "" {
+			return
+		}
+
+		j.Status = jobstore.StatusCompleted
+		if err != nil {
+			j.Status = jobstore.StatusFailed
+			j.Error = err.Error()
+		}
+
+		now := time.Now()
+		j.FinishedAt = &now
+	})
+
+	return err
+}
+
+// settleDuplicate undoes the queued status of a submitted job that didn't run
+// because another job of the video runs. The record gets back the status of
+// that job, or is marked duplicate when there was none before.
+func settleDuplicate(videoId string, previous *jobstore.Job, err error) {
+	jobstore.S.Update(videoId, func(j *jobstore.Job) {
+		if j.Status != jobstore.StatusQueued {
+			return
+		}
+
+		if previous.Status != "" {
+			j.Status = previous.Status
+			j.Error = previous.Error
+
+			return
+		}
+
+		now := time.Now()
+
+		j.Status = jobstore.StatusDuplicate
+		j.Error = err.Error()
+		j.FinishedAt = &now
+	})
+}
+
+// isDuplicate reports whether the job didn't run because the video is encoded
+// by this process or leased by another replica.
+func isDuplicate(err error) bool {
+	return errors.Is(err, amqphandler.ErrDuplicateInProgress) ||
+		errors.Is(err, amqphandler.ErrVideoBusy) ||
+		errors.As(err, new(*amqphandler.LeasedError))
+}
+
+// submitError is the status of a submitted job that didn't complete.
+func submitError(err error) error {
+	switch {
+	case isDuplicate(err):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, amqphandler.ErrSourceNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (e *encodeServer) GetJob(ctx context.Context, req *encodepb.GetJobRequest) (*encodepb.GetJobResponse, error) {
+	j, err := jobstore.S.Get(jobstore.JobId(req.VideoId, req.Version))
+	if err != nil {
+		return nil, jobError(err)
+	}
+
+	return &encodepb.GetJobResponse{Job: toJobProto(j)}, nil
+}
+
+func (e *encodeServer) ListJobs(ctx context.Context, req *encodepb.ListJobsRequest) (*encodepb.ListJobsResponse, error) {
+	jobs, err := jobstore.S.List(jobstore.Filter{
+		Status: jobstore.Status(req.Status),
+		Limit:  int(req.Limit),
+	})
+	if err != nil {
+		return nil, jobError(err)
+	}
+
+	res := &encodepb.ListJobsResponse{}
+	for _, j := range jobs {
+		res.Jobs = append(res.Jobs, toJobProto(j))
+	}
+
+	return res, nil
+}
+
+func (e *encodeServer) CancelJob(ctx context.Context, req *encodepb.CancelJobRequest) (*encodepb.CancelJobResponse, error) {
+	cancelled, err := amqphandler.CancelEncode(ctx, req.VideoId)
+	if errors.Is(err, amqphandler.ErrInvalidMessage) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &encodepb.CancelJobResponse{Cancelled: cancelled}, nil
+}
+
+func (e *encodeServer) WatchJob(req *encodepb.WatchJobRequest, stream encodepb.EncodeService_WatchJobServer) error {
+	id := jobstore.JobId(req.VideoId, req.Version)
+
+	updates, stop := jobstore.Watch(id)
+	defer stop()
+
+	j, err := jobstore.S.Get(id)
+	if err != nil {
+		return jobError(err)
+	}
+
+	for {
+		if err := stream.Send(toJobProto(j)); err != nil {
+			return err
+		}
+
+		if j.Status.IsFinal() {
+			return nil
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case j = <-updates:
+		}
+	}
+}
+
+func jobError(err error) error {
+	if errors.Is(err, jobstore.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func toJobProto(j *jobstore.Job) *encodepb.Job {
+	p := &encodepb.Job{
+		Id:        j.Id,
+		VideoId:   j.VideoId,
+		Version:   j.Version,
+		Status:    string(j.Status),
+		Stage:     j.Stage,
+		Profile:   j.Profile,
+		Attempts:  int32(j.Attempts),
+		Error:     j.Error,
+		Metadata:  string(j.Metadata),
+		CreatedAt: timestamppb.New(j.CreatedAt),
+		StartedAt: timestamppb.New(j.StartedAt),
+		UpdatedAt: timestamppb.New(j.UpdatedAt),
+	}
+
+	if j.FinishedAt != nil {
+		p.FinishedAt = timestamppb.New(*j.FinishedAt)
+	}
+
+	for _, s := range j.Stages {
+		p.Stages = append(p.Stages, &encodepb.StageTiming{
+			Name:            s.Name,
+			Attempt:         int32(s.Attempt),
+			StartedAt:       timestamppb.New(s.StartedAt),
+			DurationSeconds: s.Duration.Seconds(),
+			Error:           s.Error,
+		})
+	}
+
+	if j.Outputs != nil {
+		p.Outputs = &encodepb.Outputs{
+			Prefix:            j.Outputs.Prefix,
+			Renditions:        j.Outputs.Renditions,
+			SubtitleLanguages: j.Outputs.SubtitleLanguages,
+		}
+	}
+
+	return p
+}
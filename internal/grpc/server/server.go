@@ -6,6 +6,7 @@ import (
 
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	encodepb "github.com/sagarmaheshwary/microservices-encode-service/internal/proto/encode"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
@@ -21,6 +22,7 @@ func NewServer() *grpc.Server {
 	)
 
 	healthpb.RegisterHealthServer(server, &healthServer{})
+	encodepb.RegisterEncodeServiceServer(server, &encodeServer{})
 
 	return server
 }
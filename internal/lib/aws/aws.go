@@ -2,11 +2,16 @@ package aws
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 
 	awslib "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -14,6 +19,13 @@ import (
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
 )
 
+// Content types of streaming files that http.DetectContentType can't sniff.
+var contentTypes = map[string]string{
+	".mpd":  "application/dash+xml",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".vtt":  "text/vtt",
+}
+
 func NewSession() (*session.Session, error) {
 	c := config.Conf.AWS
 
@@ -31,7 +43,7 @@ func NewSession() (*session.Session, error) {
 	return s, nil
 }
 
-func UploadObjectToS3(filePath string, uploadPath string) error {
+func UploadObjectToS3(ctx context.Context, filePath string, uploadPath string) error {
 	c := config.Conf.AWS
 
 	s, err := NewSession()
@@ -58,12 +70,12 @@ func UploadObjectToS3(filePath string, uploadPath string) error {
 		return err
 	}
 
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Bucket:               awslib.String(c.S3Bucket),
 		Key:                  awslib.String(uploadPath),
 		Body:                 bytes.NewReader(f),
 		ContentLength:        awslib.Int64(fileStat.Size()),
-		ContentType:          awslib.String(http.DetectContentType(f)),
+		ContentType:          awslib.String(contentType(filePath, f)),
 		ContentDisposition:   awslib.String("attachment"),
 		ServerSideEncryption: awslib.String("AES256"),
 	})
@@ -77,7 +89,19 @@ func UploadObjectToS3(filePath string, uploadPath string) error {
 	return nil
 }
 
+func contentType(filePath string, b []byte) string {
+	if t, ok := contentTypes[path.Ext(filePath)]; ok {
+		return t
+	}
+
+	return http.DetectContentType(b)
+}
+
 func GetS3Object(key string) (*s3.GetObjectOutput, error) {
+	return getS3Object(context.Background(), key)
+}
+
+func getS3Object(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
 	c := config.Conf.AWS
 	s, err := NewSession()
 	svc := s3.New(s)
@@ -86,25 +110,169 @@ func GetS3Object(key string) (*s3.GetObjectOutput, error) {
 		return nil, err
 	}
 
-	res, err := svc.GetObject(&s3.GetObjectInput{
+	res, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: awslib.String(c.S3Bucket),
 		Key:    awslib.String(key),
 	})
 
-	if err != nil {
+	if err != nil && !IsNotFound(err) {
 		logger.Error("S3 get object error %v", err)
 	}
 
 	return res, err
 }
 
-func DownloadS3Object(filename string, downloadPath string) error {
-	res, err := GetS3Object(filename)
+func HeadS3Object(key string) (*s3.HeadObjectOutput, error) {
+	c := config.Conf.AWS
+
+	s, err := NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s3.New(s).HeadObject(&s3.HeadObjectInput{
+		Bucket: awslib.String(c.S3Bucket),
+		Key:    awslib.String(key),
+	})
+
+	if err != nil && !IsNotFound(err) {
+		logger.Error("S3 head object error %v", err)
+	}
+
+	return res, err
+}
+
+func PutS3Object(key string, body []byte, contentType string) error {
+	c := config.Conf.AWS
+
+	s, err := NewSession()
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(s).PutObject(&s3.PutObjectInput{
+		Bucket:               awslib.String(c.S3Bucket),
+		Key:                  awslib.String(key),
+		Body:                 bytes.NewReader(body),
+		ContentLength:        awslib.Int64(int64(len(body))),
+		ContentType:          awslib.String(contentType),
+		ServerSideEncryption: awslib.String("AES256"),
+	})
+
+	if err != nil {
+		logger.Error("S3 put object error %v", err)
+	}
+
+	return err
+}
+
+func DeleteS3Object(key string) error {
+	c := config.Conf.AWS
+
+	s, err := NewSession()
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(s).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: awslib.String(c.S3Bucket),
+		Key:    awslib.String(key),
+	})
+
+	if err != nil {
+		logger.Error("S3 delete object error %v", err)
+	}
+
+	return err
+}
+
+// ListS3Objects returns the keys of all objects under prefix.
+func ListS3Objects(prefix string) ([]string, error) {
+	c := config.Conf.AWS
+
+	s, err := NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+
+	err = s3.New(s).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: awslib.String(c.S3Bucket),
+		Prefix: awslib.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		logger.Error("S3 list objects error %v", err)
+	}
+
+	return keys, err
+}
+
+// DeleteS3Objects deletes keys in batches of the 1000 keys S3 allows per
+// request.
+func DeleteS3Objects(keys []string) error {
+	c := config.Conf.AWS
+
+	s, err := NewSession()
+	if err != nil {
+		return err
+	}
+
+	svc := s3.New(s)
+
+	for start := 0; start < len(keys); start += 1000 {
+		objects := []*s3.ObjectIdentifier{}
+		for _, k := range keys[start:min(start+1000, len(keys))] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: awslib.String(k)})
+		}
+
+		res, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: awslib.String(c.S3Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: awslib.Bool(true)},
+		})
+
+		if err != nil {
+			logger.Error("S3 delete objects error %v", err)
+
+			return err
+		}
+
+		if len(res.Errors) > 0 {
+			e := res.Errors[0]
+
+			return fmt.Errorf("unable to delete %d objects, first %q: %s", len(res.Errors), awslib.StringValue(e.Key), awslib.StringValue(e.Message))
+		}
+	}
+
+	return nil
+}
+
+// IsNotFound reports whether err is S3 saying the object doesn't exist.
+func IsNotFound(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+
+	return false
+}
+
+func DownloadS3Object(ctx context.Context, filename string, downloadPath string) error {
+	res, err := getS3Object(ctx, filename)
 
 	if err != nil {
 		return err
 	}
 
+	defer res.Body.Close()
+
 	b, err := io.ReadAll(res.Body)
 
 	if err != nil {
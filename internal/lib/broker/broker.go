@@ -4,114 +4,220 @@ import (
 	"context"
 	"fmt"
 	"math"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	amqplib "github.com/rabbitmq/amqp091-go"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
-	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/consumer"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/publisher"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/topology"
 )
 
-var (
-	Conn          *amqplib.Connection
-	reconnectLock sync.Mutex
-)
+var conn atomic.Pointer[amqplib.Connection]
+
+// session is a connection together with the publisher and consumer channels
+// opened on it. lost receives the first close of any of them.
+type session struct {
+	conn *amqplib.Connection
+	lost chan error
+}
 
+// MaintainConnection connects to RabbitMQ and re-establishes the connection,
+// the publisher and the consumer whenever the connection or one of their
+// channels closes. It only returns an error once reconnecting failed for
+// the configured number of attempts.
 func MaintainConnection(ctx context.Context) error {
-	if err := connect(); err != nil {
-		logger.Error("Initial AMQP connection attempt failed: %v", err)
-	}
+	c := config.Conf.AMQP
 
-	attempts := config.Conf.AMQP.ConnectionRetryAttempts
-	intervalSeconds := config.Conf.AMQP.ConnectionRetryIntervalSeconds
+	for {
+		s, err := connectWithRetry(ctx, c.ConnectionRetryAttempts, c.ConnectionRetryIntervalSeconds)
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
 
-	t := time.NewTicker(intervalSeconds)
-	defer t.Stop()
+		if s == nil {
+			return nil
+		}
 
-	for {
 		select {
 		case <-ctx.Done():
+			s.conn.Close()
 			return nil
-		case <-t.C:
-			if err := tryReconnect(attempts, intervalSeconds); err != nil {
-				logger.Error(err.Error())
-				return err
+		case err := <-s.lost:
+			logger.Warn("AMQP %v, reconnecting", err)
+
+			// Whatever closed, start over on a new connection so the
+			// publisher and consumer never run on different ones.
+			s.conn.Close()
+		}
+	}
+}
+
+// connectWithRetry returns a nil session when ctx is done before it could
+// connect.
+func connectWithRetry(ctx context.Context, attempts int, intervalSeconds time.Duration) (*session, error) {
+	for i := range attempts {
+		logger.Info("AMQP connection attempt: %d", i+1)
+
+		s, err := connect()
+		if err == nil {
+			return s, nil
+		}
+
+		if i+1 < attempts {
+			//retry with exponential backoff
+			exponent := math.Pow(2, float64(i))
+			delay := time.Duration(float64(intervalSeconds) * exponent)
+
+			select {
+			case <-ctx.Done():
+				return nil, nil
+			case <-time.After(delay):
 			}
 		}
 	}
+
+	return nil, fmt.Errorf("could not reconnect after %d retries", attempts)
 }
 
-func connect() error {
-	c := config.Conf.AMQP
-	address := fmt.Sprintf("%s://%s:%s@%s:%d", constant.ProtocolAMQP, c.Username, c.Password, c.Host, c.Port)
-	var err error
+func connect() (*session, error) {
+	amqpConn, err := dial(config.Conf.AMQP)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{conn: amqpConn, lost: make(chan error, 1)}
+
+	if err := s.open(); err != nil {
+		amqpConn.Close()
+		return nil, err
+	}
+
+	conn.Store(amqpConn)
+
+	return s, nil
+}
+
+// open declares the topology and starts the publisher and the consumer on
+// channels of the session's connection.
+func (s *session) open() error {
+	s.watch("connection", s.conn.NotifyClose(make(chan *amqplib.Error, 1)))
+
+	if err := s.openPublisher(); err != nil {
+		return err
+	}
 
-	Conn, err = amqplib.Dial(address)
+	consumerChan, err := s.channel("consumer")
 	if err != nil {
-		logger.Error("AMQP connection error %v", err)
 		return err
 	}
 
-	logger.Info("AMQP connected on %q", address)
+	// A queue deleted or failed over by the broker cancels its consumer but
+	// leaves the channel open.
+	cancels := consumerChan.NotifyCancel(make(chan string, 1))
+	go func() {
+		if tag, ok := <-cancels; ok {
+			s.lose(fmt.Errorf("consumer %q cancelled by the broker", tag))
+		}
+	}()
 
-	publisherChan, err := NewChannel()
-	if err != nil {
-		logger.Error("Unable to create publisher channel %v", err)
+	return consumer.Init(consumerChan).Consume()
+}
+
+func (s *session) openPublisher() error {
+	if err := s.declareTopology(); err != nil {
 		return err
 	}
-	publisher.Init(publisherChan)
 
-	consumerChan, err := NewChannel()
+	publisherChan, err := s.channel("publisher")
 	if err != nil {
-		logger.Error("Unable to create consumer channel %v", err)
 		return err
 	}
-	go consumer.Init(consumerChan).Consume()
 
-	return nil
+	return publisher.Init(publisherChan)
 }
 
-func tryReconnect(attempts int, intervalSeconds time.Duration) error {
-	reconnectLock.Lock()
-	defer reconnectLock.Unlock()
+// declareTopology declares the exchanges, queues and bindings on a channel of
+// its own since a failed declaration closes the channel.
+func (s *session) declareTopology() error {
+	t, err := topology.FromConfig(config.Conf.AMQP)
+	if err != nil {
+		logger.Error("Invalid AMQP topology %v", err)
+		return err
+	}
 
-	if HealthCheck() {
-		return nil
+	for _, key := range t.UnboundKeys(config.Conf.AMQP.Exchange) {
+		logger.Warn("No AMQP_BINDINGS route %q events to a queue, they stay in the outbox until one is bound", key)
 	}
 
-	for i := range attempts {
-		logger.Info("AMQP connection attempt: %d, interval: %v", i+1, intervalSeconds*(1<<i))
+	ch, err := s.conn.Channel()
+	if err != nil {
+		logger.Error("AMQP channel error %v", err)
+		return err
+	}
+	defer ch.Close()
 
-		if err := connect(); err == nil {
-			return nil
-		}
+	return topology.Declare(ch, t)
+}
 
-		if i+1 < attempts {
-			//retry with exponential backoff
-			exponent := math.Pow(2, float64(i))
-			delay := time.Duration(float64(intervalSeconds) * exponent)
-			time.Sleep(delay)
-		}
+func (s *session) channel(name string) (*amqplib.Channel, error) {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		logger.Error("Unable to create %s channel %v", name, err)
+		return nil, err
 	}
 
-	return fmt.Errorf("could not reconnect after %d retries", attempts)
+	s.watch(name+" channel", ch.NotifyClose(make(chan *amqplib.Error, 1)))
+
+	return ch, nil
+}
+
+// watch reports the close of the connection or channel to the session. The
+// notification channel is closed without an error on a graceful close.
+func (s *session) watch(name string, closes <-chan *amqplib.Error) {
+	go func() {
+		err, ok := <-closes
+		if ok && err != nil {
+			s.lose(fmt.Errorf("%s closed: %v", name, err))
+			return
+		}
+
+		s.lose(fmt.Errorf("%s closed", name))
+	}()
 }
 
-func NewChannel() (*amqplib.Channel, error) {
-	c, err := Conn.Channel()
+func (s *session) lose(err error) {
+	select {
+	case s.lost <- err:
+	default:
+	}
+}
+
+// ConnectPublisher connects and sets up the publisher only, for commands that
+// publish a few messages and exit. The returned func closes the connection.
+func ConnectPublisher() (func() error, error) {
+	amqpConn, err := dial(config.Conf.AMQP)
 	if err != nil {
-		logger.Error("AMQP channel error %v", err)
 		return nil, err
 	}
 
-	return c, nil
+	s := &session{conn: amqpConn, lost: make(chan error, 1)}
+
+	if err := s.openPublisher(); err != nil {
+		amqpConn.Close()
+		return nil, err
+	}
+
+	return amqpConn.Close, nil
 }
 
 func HealthCheck() bool {
-	if Conn == nil || Conn.IsClosed() {
+	c := conn.Load()
+
+	if c == nil || c.IsClosed() {
 		logger.Info("AMQP health check failed!")
 		return false
 	}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	amqplib "github.com/rabbitmq/amqp091-go"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+// dial opens a connection with the URI, TLS and auth settings of c.
+func dial(c *config.AMQP) (*amqplib.Connection, error) {
+	uri, err := amqpURI(c)
+	if err != nil {
+		logger.Error("Invalid AMQP URI %v", err)
+		return nil, err
+	}
+
+	amqpConfig := amqplib.Config{
+		Vhost:      uri.Vhost,
+		Properties: amqplib.NewConnectionProperties(),
+	}
+	amqpConfig.Properties.SetClientConnectionName(c.ConnectionName)
+
+	if c.AuthMechanism == constant.AMQPAuthExternal {
+		amqpConfig.SASL = []amqplib.Authentication{&amqplib.ExternalAuth{}}
+	} else {
+		amqpConfig.SASL = []amqplib.Authentication{uri.PlainAuth()}
+	}
+
+	if uri.Scheme == constant.ProtocolAMQPS {
+		amqpConfig.TLSClientConfig, err = tlsConfig(c)
+		if err != nil {
+			logger.Error("Invalid AMQP TLS config %v", err)
+			return nil, err
+		}
+	}
+
+	address := redactedURI(uri)
+
+	conn, err := amqplib.DialConfig(uri.String(), amqpConfig)
+	if err != nil {
+		logger.Error("AMQP connection error on %q: %v", address, err)
+		return nil, err
+	}
+
+	logger.Info("AMQP connected on %q as %q", address, c.ConnectionName)
+
+	return conn, nil
+}
+
+// amqpURI parses c.URI, or builds the URI from the separate settings when it
+// isn't set.
+func amqpURI(c *config.AMQP) (amqplib.URI, error) {
+	if c.URI != "" {
+		return amqplib.ParseURI(c.URI)
+	}
+
+	scheme := constant.ProtocolAMQP
+	if c.TLS {
+		scheme = constant.ProtocolAMQPS
+	}
+
+	return amqplib.URI{
+		Scheme:   scheme,
+		Host:     c.Host,
+		Port:     c.Port,
+		Username: c.Username,
+		Password: c.Password,
+		Vhost:    c.VHost,
+	}, nil
+}
+
+func tlsConfig(c *config.AMQP) (*tls.Config, error) {
+	t := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA bundle contains no certificates")
+		}
+	}
+
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
+
+// redactedURI is the URI with its password masked, for logging.
+func redactedURI(uri amqplib.URI) string {
+	if uri.Password != "" {
+		uri.Password = "xxxxx"
+	}
+
+	return uri.String()
+}
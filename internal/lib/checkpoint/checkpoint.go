@@ -0,0 +1,203 @@
+package checkpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+// Manifest records the completed stages of a job inside its temp directory so
+// a redelivered message can resume where the previous attempt stopped.
+type Manifest struct {
+	path string
+	mu   sync.Mutex
+
+	VideoId string `json:"video_id"`
+	// SourceETag is the S3 ETag of the raw video the progress belongs to.
+	SourceETag     string            `json:"source_etag"`
+	SourceChecksum string            `json:"source_checksum"`
+	Stages         map[string]*Stage `json:"stages"`
+	Uploaded       map[string]bool   `json:"uploaded"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+type Stage struct {
+	CompletedAt time.Time       `json:"completed_at"`
+	Data        json.RawMessage `json:"data,omitempty"`
+}
+
+// Load reads the manifest at p, or returns an empty one for videoId when the
+// file doesn't exist or belongs to another video or upload of it.
+func Load(p string, videoId string, sourceETag string) (*Manifest, error) {
+	m := &Manifest{path: p}
+
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Unable to read job manifest %q: %v", p, err)
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(b, m); err != nil {
+			logger.Warn("Ignoring corrupt job manifest %q: %v", p, err)
+		}
+	}
+
+	if m.VideoId != videoId || m.SourceETag != sourceETag {
+		m.VideoId = videoId
+		m.SourceETag = sourceETag
+		m.SourceChecksum = ""
+		m.Stages = nil
+		m.Uploaded = nil
+	}
+
+	if m.Stages == nil {
+		m.Stages = map[string]*Stage{}
+	}
+
+	if m.Uploaded == nil {
+		m.Uploaded = map[string]bool{}
+	}
+
+	return m, nil
+}
+
+// SourceChanged reports whether the manifest at p was written for another
+// upload of the video than the one with sourceETag.
+func SourceChanged(p string, sourceETag string) bool {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return false
+	}
+
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return false
+	}
+
+	return m.SourceETag != sourceETag
+}
+
+func (m *Manifest) IsDone(stage string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.Stages[stage]
+
+	return ok
+}
+
+// Data decodes the data saved with a completed stage into v.
+func (m *Manifest) Data(stage string, v any) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.Stages[stage]
+	if !ok || s.Data == nil {
+		return false
+	}
+
+	return json.Unmarshal(s.Data, v) == nil
+}
+
+func (m *Manifest) Complete(stage string) error {
+	return m.CompleteWithData(stage, nil)
+}
+
+// CompleteWithData marks the stage as completed and saves v with it.
+func (m *Manifest) CompleteWithData(stage string, v any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &Stage{CompletedAt: time.Now()}
+
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		s.Data = b
+	}
+
+	m.Stages[stage] = s
+
+	return m.save()
+}
+
+func (m *Manifest) IsUploaded(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Uploaded[key]
+}
+
+func (m *Manifest) MarkUploaded(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Uploaded[key] = true
+
+	return m.save()
+}
+
+// Reset forgets all progress, used when the source changed since the
+// manifest was written.
+func (m *Manifest) Reset(sourceChecksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.SourceChecksum = sourceChecksum
+	m.Stages = map[string]*Stage{}
+	m.Uploaded = map[string]bool{}
+
+	return m.save()
+}
+
+// save writes the manifest to a temp file and renames it so a crash never
+// leaves a partially written manifest behind.
+func (m *Manifest) save() error {
+	m.UpdatedAt = time.Now()
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		logger.Error("Unable to write job manifest %q: %v", tmp, err)
+		return err
+	}
+
+	if err := os.Rename(tmp, m.path); err != nil {
+		logger.Error("Unable to save job manifest %q: %v", m.path, err)
+		return err
+	}
+
+	return nil
+}
+
+// FileChecksum returns the hex encoded SHA-256 of the file at p.
+func FileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,18 @@
+package consumer
+
+import (
+	"context"
+
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+)
+
+func init() {
+	Register(&Handler{
+		Key:     constant.MessageTypeCancelEncode,
+		NewData: func() Payload { return new(amqphandler.CancelEncodeMessage) },
+		Handle: func(ctx context.Context, m *Message) error {
+			return amqphandler.ProcessCancelEncodeMessage(ctx, m.Data.(*amqphandler.CancelEncodeMessage))
+		},
+	})
+}
@@ -3,135 +3,133 @@ package consumer
 import (
 	"context"
 	"encoding/json"
-	"time"
+	"fmt"
+	"strconv"
 
 	amqplib "github.com/rabbitmq/amqp091-go"
-	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
-	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/prometheus"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
 )
 
-var C *Consumer
-
+// Consumer consumes the queues of the service on one channel. Every reconnect
+// creates a new Consumer on a new channel.
 type Consumer struct {
 	channel *amqplib.Channel
 }
 
+// MessageType is the envelope of every consumed message. Data is decoded
+// once the key tells its type.
 type MessageType struct {
-	Key  string `json:"key"`
-	Data any    `json:"data"`
+	SchemaVersion int             `json:"schema_version"`
+	MessageId     string          `json:"message_id"`
+	Key           string          `json:"key"`
+	Data          json.RawMessage `json:"data"`
 }
 
 func (c *Consumer) Consume() error {
-	q, err := c.declareQueue(constant.QueueEncodeService)
-	if err != nil {
-		logger.Fatal("AMQP queue listen failed %v", err)
-	}
-
-	messages, err := c.channel.Consume(
-		q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		logger.Fatal("AMQP queue listen failed %v", err)
+	if err := c.channel.Qos(config.Conf.AMQP.PrefetchCount, 0, false); err != nil {
+		logger.Error("AMQP set prefetch count failed %v", err)
+		return err
 	}
 
-	logger.Info("AMQP listening on queue %q", constant.QueueEncodeService)
-
-	go func() {
-		for message := range messages {
-			ctx := contextWithOtelHeaders(message.Headers)
-
-			tracer := otel.Tracer(constant.ServiceName)
-			ctx, span := tracer.Start(ctx, constant.TraceTypeRabbitMQConsume)
-
-			m := MessageType{}
-			if err := json.Unmarshal(message.Body, &m); err != nil {
-				span.RecordError(err)
-				span.SetStatus(codes.Error, "failed to unmarshal base message")
-				logger.Error("Failed to unmarshal message body: %v", err)
-
-				continue
-			}
-
-			span.SetAttributes(attribute.String("message_key", m.Key))
-
-			logger.Info("AMQP Message received %q: %v", m.Key, m.Data)
-
-			prometheus.TotalMessagesCounter.WithLabelValues(m.Key).Inc()
-			start := time.Now()
-
-			switch m.Key {
-			case constant.MessageTypeEncodeUploadedVideo:
-				type MessageType struct {
-					Key  string                           `json:"key"`
-					Data amqphandler.VideoUploadedMessage `json:"data"`
-				}
-				d := new(MessageType)
-
-				if err := json.Unmarshal(message.Body, d); err != nil {
-					span.RecordError(err)
-					span.SetStatus(codes.Error, "failed to unmarshal message")
-					logger.Error("Failed to unmarshal message %s: %s", m.Key, err)
-					continue
-				}
-
-				err := amqphandler.ProcessVideoUploadedMessage(ctx, &d.Data)
-				if err == nil {
-					message.Ack(false)
-					prometheus.MessageProcessingDuration.WithLabelValues(m.Key).Observe(time.Since(start).Seconds())
-					span.SetStatus(codes.Ok, "message processed successfully")
-				} else {
-					span.RecordError(err)
-					span.SetStatus(codes.Error, "message processing failed")
-					logger.Error("Failed to process message %s: %s", m.Key, err)
-					prometheus.MessageProcessingErrorsCounter.WithLabelValues(m.Key, err.Error()).Inc()
-				}
-			default:
-				span.AddEvent("unknown message type")
-				logger.Warn("Unknown message key: %s", m.Key)
-			}
-
-			span.End()
+	// Control messages like cancellations have their own queue so they aren't
+	// stuck behind the encode this consumer is busy with.
+	for _, queue := range []string{constant.QueueEncodeService, constant.QueueEncodeServiceControl} {
+		messages, err := c.channel.Consume(
+			queue,
+			"",
+			false,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			logger.Error("AMQP queue listen failed %v", err)
+			return err
 		}
-	}()
+
+		logger.Info("AMQP listening on queue %q", queue)
+
+		go c.handleMessages(queue, messages)
+	}
 
 	return nil
 }
 
-func (c *Consumer) declareQueue(queue string) (*amqplib.Queue, error) {
-	q, err := c.channel.QueueDeclare(
-		queue,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+// handleMessages returns once the channel closed or the broker cancelled the
+// consumer, the broker keeps the unacked messages for the next consumer.
+func (c *Consumer) handleMessages(queue string, messages <-chan amqplib.Delivery) {
+	defer logger.Info("AMQP stopped listening on queue %q", queue)
+
+	for message := range messages {
+		c.handleMessage(message)
+	}
+}
 
-	if err != nil {
-		logger.Error("AMQP declare queue error %v", err)
+// handleMessage runs the handler of the message key through the middleware
+// and settles the delivery as the handler's retry policy says.
+func (c *Consumer) handleMessage(delivery amqplib.Delivery) {
+	ctx := contextWithOtelHeaders(delivery.Headers)
 
-		return nil, err
+	m := &Message{
+		Delivery: delivery,
+		Priority: strconv.Itoa(int(delivery.Priority)),
 	}
 
-	return &q, err
+	var h *Handler
+
+	if err := json.Unmarshal(delivery.Body, &m.MessageType); err != nil {
+		h = failingHandler("", fmt.Errorf("%w: %w", ErrMalformedMessage, err))
+	} else {
+		if m.MessageId == "" {
+			m.MessageId = delivery.MessageId
+		}
+
+		// Messages from before the envelope was versioned have no
+		// schema_version.
+		if m.SchemaVersion == 0 {
+			m.SchemaVersion = 1
+		}
+
+		h = handlerOf(m)
+	}
+
+	err := chain(h)(ctx, m)
+
+	if m.handedOver {
+		return
+	}
+
+	switch h.retry(err) {
+	case ActionAck:
+		ack(m.Delivery)
+	case ActionRequeue:
+		nack(m.Delivery, true)
+	case ActionReject:
+		nack(m.Delivery, false)
+	}
 }
 
-func Init(channel *amqplib.Channel) *Consumer {
-	C = &Consumer{channel: channel}
+// ack and nack only log failures: once its channel closed the delivery tag is
+// invalid and the broker redelivers the message anyway.
+func ack(d amqplib.Delivery) {
+	if err := d.Ack(false); err != nil {
+		logger.Warn("Unable to ack message %q, the broker will redeliver it: %v", d.MessageId, err)
+	}
+}
+
+func nack(d amqplib.Delivery, requeue bool) {
+	if err := d.Nack(false, requeue); err != nil {
+		logger.Warn("Unable to nack message %q, the broker will redeliver it: %v", d.MessageId, err)
+	}
+}
 
-	return C
+func Init(channel *amqplib.Channel) *Consumer {
+	return &Consumer{channel: channel}
 }
 
 func contextWithOtelHeaders(headers amqplib.Table) context.Context {
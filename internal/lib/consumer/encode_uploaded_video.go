@@ -0,0 +1,176 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqplib "github.com/rabbitmq/amqp091-go"
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runningJobs maps every encode in progress, by job id, to the delivery it
+// settles once done. A reconnect invalidates the delivery tags of the old
+// channel, so the message the broker redelivers meanwhile takes the place of
+// the original one.
+var runningJobs = struct {
+	sync.Mutex
+	deliveries map[string]*runningJob
+}{deliveries: map[string]*runningJob{}}
+
+type runningJob struct {
+	delivery amqplib.Delivery
+	channel  *amqplib.Channel
+}
+
+func init() {
+	Register(&Handler{
+		Key:     constant.MessageTypeEncodeUploadedVideo,
+		NewData: func() Payload { return new(amqphandler.VideoUploadedMessage) },
+		Handle:  handleEncodeUploadedVideo,
+		Retry:   encodeRetryPolicy,
+	})
+}
+
+func handleEncodeUploadedVideo(ctx context.Context, m *Message) error {
+	data := m.Data.(*amqphandler.VideoUploadedMessage)
+
+	return runEncode(ctx, m, jobstore.JobId(data.VideoId, ""), func() error {
+		return amqphandler.ProcessVideoUploadedMessage(ctx, data)
+	})
+}
+
+// runEncode runs the encode job and settles the outcomes that aren't
+// failures. Every job type encoding a video runs through it so a redelivery
+// during a reconnect is handed over to the running job.
+func runEncode(ctx context.Context, m *Message, jobId string, process func() error) error {
+	span := trace.SpanFromContext(ctx)
+
+	done, handedOver := trackJob(jobId, m.Delivery)
+	if handedOver {
+		// The encode is still running, it settles this delivery since its
+		// own one can't be acked anymore.
+		span.AddEvent("redelivery handed over to running job")
+		logger.Info("Message %s of job %q handed over to the running job", m.Key, jobId)
+
+		m.handedOver = true
+
+		return nil
+	}
+
+	err := process()
+	m.Delivery = done()
+
+	var leased *amqphandler.LeasedError
+
+	switch {
+	case errors.As(err, &leased):
+		// The lease may be left over from a replica that died, so the message
+		// is requeued once the lease was due to be renewed or expired.
+		span.AddEvent("video leased by another replica")
+		logger.Warn("Job %q is leased by %s until %v, requeueing message %s", jobId, leased.Owner, leased.ExpiresAt, m.Key)
+
+		waitBeforeRequeue(ctx, min(time.Until(leased.ExpiresAt), requeueDelay()))
+
+		return err
+	case errors.Is(err, amqphandler.ErrVideoBusy):
+		// Another job of the video runs in this process and nothing settles
+		// this message for it.
+		span.AddEvent("video busy")
+		logger.Warn("Requeueing message %s of job %q: %s", m.Key, jobId, err)
+
+		waitBeforeRequeue(ctx, requeueDelay())
+
+		return err
+	case errors.Is(err, amqphandler.ErrDuplicateInProgress):
+		// The same job already running in this process acks or redelivers
+		// its own message.
+		span.AddEvent("duplicate message")
+		logger.Warn("Skipping duplicate message %s of job %q: %s", m.Key, jobId, err)
+
+		return nil
+	case errors.Is(err, context.Canceled):
+		// Cancelled jobs aren't retried.
+		span.AddEvent("job cancelled")
+		logger.Warn("Cancelled message %s of job %q", m.Key, jobId)
+
+		return nil
+	}
+
+	return err
+}
+
+// requeueDelay is how long a message of a video that's being encoded waits
+// before it's requeued, the renewal interval of the encode's lease.
+func requeueDelay() time.Duration {
+	return config.Conf.Job.LeaseSeconds / 3
+}
+
+// waitBeforeRequeue waits for delay so the requeued message isn't
+// redelivered in a loop meanwhile.
+func waitBeforeRequeue(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// encodeRetryPolicy requeues failed encodes, including the ones that ran out
+// of disk space so a replica with enough disk can take them, until the job
+// store says the video ran out of attempts or its raw video doesn't exist.
+func encodeRetryPolicy(err error) Action {
+	if errors.Is(err, amqphandler.ErrAttemptsExhausted) || errors.Is(err, amqphandler.ErrSourceNotFound) {
+		return ActionReject
+	}
+
+	return DefaultRetryPolicy(err)
+}
+
+// trackJob registers d as the delivery of the job and returns the func that
+// returns the delivery to settle once the job is done. When the job is still
+// running from a channel that closed since, d replaces its delivery and
+// handedOver is true.
+func trackJob(jobId string, d amqplib.Delivery) (done func() amqplib.Delivery, handedOver bool) {
+	channel, _ := d.Acknowledger.(*amqplib.Channel)
+
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+
+	if r, ok := runningJobs.deliveries[jobId]; ok {
+		if r.channel != nil && r.channel.IsClosed() {
+			r.delivery = d
+			r.channel = channel
+
+			return nil, true
+		}
+
+		// A duplicate while the delivery of the running encode is still
+		// valid, the handler rejects it.
+		return func() amqplib.Delivery { return d }, false
+	}
+
+	r := &runningJob{delivery: d, channel: channel}
+	runningJobs.deliveries[jobId] = r
+
+	return func() amqplib.Delivery {
+		runningJobs.Lock()
+		defer runningJobs.Unlock()
+
+		delete(runningJobs.deliveries, jobId)
+
+		return r.delivery
+	}, false
+}
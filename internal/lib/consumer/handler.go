@@ -0,0 +1,156 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	amqplib "github.com/rabbitmq/amqp091-go"
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+)
+
+var (
+	ErrMalformedMessage         = errors.New("malformed message")
+	ErrUnknownKey               = errors.New("unknown message key")
+	ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+)
+
+// Message is a delivery with its decoded envelope and data.
+type Message struct {
+	MessageType
+	// Delivery is settled once the handler returned. A handler may replace
+	// it, e.g. with a redelivery of the same message.
+	Delivery amqplib.Delivery
+	Priority string
+	// Data is the value returned by the handler's NewData, decoded from the
+	// envelope's data and validated.
+	Data any
+	// handedOver tells Delivery was passed to another handler that settles
+	// it.
+	handedOver bool
+}
+
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// Handler processes the messages of one key.
+type Handler struct {
+	Key string
+	// NewData returns a new value of the payload type of the key.
+	NewData func() Payload
+	Handle  HandlerFunc
+	// Retry decides how the message is settled after Handle returned, nil
+	// means DefaultRetryPolicy.
+	Retry RetryPolicy
+}
+
+type Payload interface {
+	Validate() error
+}
+
+// Action is how a message is settled.
+type Action int
+
+const (
+	ActionAck Action = iota
+	ActionRequeue
+	// ActionReject nacks without requeue, which dead-letters the message.
+	ActionReject
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAck:
+		return "ack"
+	case ActionRequeue:
+		return "requeue"
+	default:
+		return "reject"
+	}
+}
+
+type RetryPolicy func(err error) Action
+
+// DefaultRetryPolicy acks processed messages, rejects the ones that can never
+// be processed or whose handler panicked and requeues the rest.
+func DefaultRetryPolicy(err error) Action {
+	switch {
+	case err == nil:
+		return ActionAck
+	case errors.Is(err, amqphandler.ErrInvalidMessage),
+		errors.Is(err, ErrMalformedMessage),
+		errors.Is(err, ErrUnknownKey),
+		errors.Is(err, ErrUnsupportedSchemaVersion),
+		errors.As(err, new(*amqphandler.PanicError)):
+		return ActionReject
+	default:
+		return ActionRequeue
+	}
+}
+
+func (h *Handler) retry(err error) Action {
+	if h.Retry == nil {
+		return DefaultRetryPolicy(err)
+	}
+
+	return h.Retry(err)
+}
+
+var handlers = map[string]*Handler{}
+
+// Register adds the handler of a message key. It's meant to be called from
+// init and panics on a duplicate key.
+func Register(h *Handler) {
+	if _, ok := handlers[h.Key]; ok {
+		panic(fmt.Sprintf("consumer: handler of %q registered twice", h.Key))
+	}
+
+	handlers[h.Key] = h
+}
+
+// handlerOf returns the handler of the message and decodes its data. Messages
+// that can't be handled get a handler that returns why, so they go through
+// the middleware like any other message.
+func handlerOf(m *Message) *Handler {
+	if m.SchemaVersion > constant.MessageSchemaVersion {
+		return failingHandler(m.Key, fmt.Errorf("%w: %d is newer than %d", ErrUnsupportedSchemaVersion, m.SchemaVersion, constant.MessageSchemaVersion))
+	}
+
+	h, ok := handlers[m.Key]
+	if !ok {
+		return failingHandler(m.Key, fmt.Errorf("%w %q", ErrUnknownKey, m.Key))
+	}
+
+	data := h.NewData()
+
+	if err := decodeData(&m.MessageType, data); err != nil {
+		return failingHandler(m.Key, err)
+	}
+
+	m.Data = data
+
+	return h
+}
+
+func failingHandler(key string, err error) *Handler {
+	return &Handler{
+		Key: key,
+		Handle: func(ctx context.Context, m *Message) error {
+			return err
+		},
+	}
+}
+
+// decodeData decodes the data of the envelope into v and validates it.
+func decodeData(m *MessageType, v Payload) error {
+	if len(m.Data) == 0 || string(m.Data) == "null" {
+		return fmt.Errorf("%w: data is required", amqphandler.ErrInvalidMessage)
+	}
+
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		return fmt.Errorf("%w: %w", amqphandler.ErrInvalidMessage, err)
+	}
+
+	return v.Validate()
+}
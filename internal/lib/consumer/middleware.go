@@ -0,0 +1,139 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware wraps the Handle func of h.
+type Middleware func(h *Handler, next HandlerFunc) HandlerFunc
+
+// middleware runs around every handler, the first one outermost.
+var middleware = []Middleware{
+	Tracing,
+	Logging,
+	Metrics,
+	Recovery,
+}
+
+func chain(h *Handler) HandlerFunc {
+	next := h.Handle
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](h, next)
+	}
+
+	return next
+}
+
+// Tracing runs the handler in a consume span, a child of the publisher's
+// span when the message headers carry one.
+func Tracing(h *Handler, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, m *Message) error {
+		tracer := otel.Tracer(constant.ServiceName)
+		ctx, span := tracer.Start(ctx, constant.TraceTypeRabbitMQConsume)
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("message_key", m.Key),
+			attribute.String("message_id", m.MessageId),
+			attribute.Int("schema_version", m.SchemaVersion),
+			attribute.String("priority", m.Priority),
+		)
+
+		err := next(ctx, m)
+
+		action := h.retry(err)
+		span.AddEvent("settled", trace.WithAttributes(attribute.String("action", action.String())))
+
+		var panicErr *amqphandler.PanicError
+
+		if errors.As(err, &panicErr) {
+			span.RecordError(err, trace.WithAttributes(attribute.String("exception.stacktrace", panicErr.Stack)))
+			span.SetStatus(codes.Error, "message handler panicked")
+		} else if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "message processing failed")
+		} else {
+			span.SetStatus(codes.Ok, "message processed successfully")
+		}
+
+		return err
+	}
+}
+
+func Logging(h *Handler, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, m *Message) error {
+		logger.Info("AMQP Message received %q (id %q, schema version %d): %s", m.Key, m.MessageId, m.SchemaVersion, m.MessageType.Data)
+
+		err := next(ctx, m)
+		if err != nil {
+			logger.Error("Failed to process message %q (id %q), %s: %v", m.Key, m.MessageId, h.retry(err), err)
+		}
+
+		return err
+	}
+}
+
+func Metrics(h *Handler, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, m *Message) error {
+		prometheus.TotalMessagesCounter.WithLabelValues(m.Key, m.Priority).Inc()
+		start := time.Now()
+
+		err := next(ctx, m)
+		if err != nil {
+			prometheus.MessageProcessingErrorsCounter.WithLabelValues(m.Key, m.Priority, errorReason(err)).Inc()
+		} else {
+			prometheus.MessageProcessingDuration.WithLabelValues(m.Key, m.Priority).Observe(time.Since(start).Seconds())
+		}
+
+		return err
+	}
+}
+
+// Recovery turns a panic of the handler into a PanicError so the consumer
+// keeps running and the message is dead-lettered.
+func Recovery(h *Handler, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, m *Message) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = amqphandler.NewPanicError(m.Key, v)
+			}
+		}()
+
+		return next(ctx, m)
+	}
+}
+
+// errorReason is the reason label of the error counter, a fixed value for the
+// messages that are rejected without being processed.
+func errorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrMalformedMessage):
+		return "malformed"
+	case errors.Is(err, ErrUnknownKey):
+		return "unknown_key"
+	case errors.Is(err, ErrUnsupportedSchemaVersion):
+		return "unsupported_schema_version"
+	case errors.Is(err, amqphandler.ErrInvalidMessage):
+		return "invalid"
+	case errors.As(err, new(*amqphandler.PanicError)):
+		return "panic"
+	case errors.As(err, new(*amqphandler.LeasedError)):
+		return "leased"
+	case errors.Is(err, amqphandler.ErrVideoBusy):
+		return "busy"
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,24 @@
+package consumer
+
+import (
+	"context"
+
+	amqphandler "github.com/sagarmaheshwary/microservices-encode-service/internal/amqp-handler"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/jobstore"
+)
+
+func init() {
+	Register(&Handler{
+		Key:     constant.MessageTypeReEncodeVideo,
+		NewData: func() Payload { return new(amqphandler.ReEncodeVideoMessage) },
+		Handle: func(ctx context.Context, m *Message) error {
+			data := m.Data.(*amqphandler.ReEncodeVideoMessage)
+
+			return runEncode(ctx, m, jobstore.JobId(data.VideoId, data.Version), func() error {
+				return amqphandler.ProcessReEncodeVideoMessage(ctx, data)
+			})
+		},
+		Retry: encodeRetryPolicy,
+	})
+}
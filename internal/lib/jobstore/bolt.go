@@ -0,0 +1,132 @@
+package jobstore
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var jobsBucket = []byte("jobs")
+
+// BoltStore keeps jobs as JSON in a single BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(p string) (*BoltStore, error) {
+	db, err := bolt.Open(p, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		logger.Error("Unable to open job store %q: %v", p, err)
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(id string) (*Job, error) {
+	var j *Job
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		j, err = getJob(tx.Bucket(jobsBucket), id)
+		return err
+	})
+
+	return j, err
+}
+
+func (s *BoltStore) Update(id string, fn func(j *Job)) (*Job, error) {
+	var j *Job
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+
+		var err error
+		j, err = getJob(b, id)
+		if errors.Is(err, ErrNotFound) {
+			j = newJob(id)
+		} else if err != nil {
+			return err
+		}
+
+		fn(j)
+		j.UpdatedAt = time.Now()
+
+		v, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(id), v)
+	})
+	if err != nil {
+		logger.Error("Unable to update job %s: %v", id, err)
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (s *BoltStore) List(f Filter) ([]*Job, error) {
+	jobs := []*Job{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			j := new(Job)
+			if err := json.Unmarshal(v, j); err != nil {
+				logger.Warn("Skipping malformed job %q: %v", k, err)
+				return nil
+			}
+
+			if j.Id == "" {
+				j.Id = string(k)
+			}
+
+			if f.matches(j) {
+				jobs = append(jobs, j)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortAndLimit(jobs, f), nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func getJob(b *bolt.Bucket, id string) (*Job, error) {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+
+	j := new(Job)
+	if err := json.Unmarshal(v, j); err != nil {
+		return nil, err
+	}
+
+	// Jobs recorded before they had an id are keyed by their video id.
+	if j.Id == "" {
+		j.Id = id
+	}
+
+	return j, nil
+}
@@ -0,0 +1,157 @@
+package jobstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+const (
+	DriverBolt   = "bolt"
+	DriverMemory = "memory"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusRetrying  Status = "retrying"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+	StatusCompleted Status = "completed"
+	// StatusDuplicate is a submitted job that didn't run because the video
+	// was being encoded by another job.
+	StatusDuplicate Status = "duplicate"
+)
+
+// IsFinal reports whether the job won't change anymore unless it's submitted
+// again.
+func (s Status) IsFinal() bool {
+	return s == StatusFailed || s == StatusCancelled || s == StatusCompleted || s == StatusDuplicate
+}
+
+var ErrNotFound = errors.New("job not found")
+
+var S Store
+
+// Store keeps a record of every job the service ran, keyed by JobId.
+type Store interface {
+	Get(id string) (*Job, error)
+	// Update applies fn to the job, creating it when it doesn't exist yet,
+	// and saves the result.
+	Update(id string, fn func(j *Job)) (*Job, error)
+	List(filter Filter) ([]*Job, error)
+	Close() error
+}
+
+type Job struct {
+	Id      string `json:"id"`
+	VideoId string `json:"video_id"`
+	// Version is the output version of a re-encode, empty for uploads.
+	Version string `json:"version,omitempty"`
+	Status  Status `json:"status"`
+	// Stage is the stage the job is in, or was in when it stopped.
+	Stage string `json:"stage,omitempty"`
+	// Input is the message the job was started from.
+	Input json.RawMessage `json:"input,omitempty"`
+	// Metadata is the probed info of the source video.
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+	Profile    string          `json:"profile,omitempty"`
+	Stages     []*StageTiming  `json:"stages,omitempty"`
+	Outputs    *Outputs        `json:"outputs,omitempty"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  time.Time       `json:"started_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+type StageTiming struct {
+	Name      string        `json:"name"`
+	Attempt   int           `json:"attempt"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type Outputs struct {
+	Prefix            string   `json:"prefix"`
+	Renditions        []string `json:"renditions"`
+	SubtitleLanguages []string `json:"subtitle_languages,omitempty"`
+}
+
+type Filter struct {
+	// Status only returns jobs in this status when set.
+	Status Status
+	// Limit caps the number of jobs returned, most recently updated first.
+	Limit int
+}
+
+func (f Filter) matches(j *Job) bool {
+	return f.Status == "" || j.Status == f.Status
+}
+
+// Init opens the store of the given driver and makes it the default one.
+func Init(driver string, p string) error {
+	var err error
+
+	var store Store
+
+	switch driver {
+	case DriverBolt:
+		store, err = NewBoltStore(p)
+	case DriverMemory:
+		store = NewMemoryStore()
+	default:
+		err = fmt.Errorf("unknown job store driver %q", driver)
+	}
+
+	if err != nil {
+		logger.Error("Unable to open job store: %v", err)
+		return err
+	}
+
+	S = &watchedStore{Store: store}
+
+	logger.Info("Using %s job store", driver)
+
+	return nil
+}
+
+// sortAndLimit orders jobs by most recently updated first and applies the
+// filter's limit.
+func sortAndLimit(jobs []*Job, f Filter) []*Job {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].UpdatedAt.After(jobs[j].UpdatedAt)
+	})
+
+	if f.Limit > 0 && len(jobs) > f.Limit {
+		jobs = jobs[:f.Limit]
+	}
+
+	return jobs
+}
+
+// JobId is the key of the job of a video: the video id for uploads and
+// video_id@version for re-encodes, so a re-encode doesn't overwrite the
+// record of the upload.
+func JobId(videoId string, version string) string {
+	if version == "" {
+		return videoId
+	}
+
+	return videoId + "@" + version
+}
+
+func newJob(id string) *Job {
+	videoId, version, _ := strings.Cut(id, "@")
+
+	return &Job{Id: id, VideoId: videoId, Version: version, CreatedAt: time.Now()}
+}
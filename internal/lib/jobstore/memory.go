@@ -0,0 +1,76 @@
+package jobstore
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps jobs for the lifetime of the process only.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: map[string]*Job{}}
+}
+
+func (s *MemoryStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyJob(j), nil
+}
+
+func (s *MemoryStore) Update(id string, fn func(j *Job)) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if ok {
+		j = copyJob(j)
+	} else {
+		j = newJob(id)
+	}
+
+	fn(j)
+	j.UpdatedAt = time.Now()
+
+	s.jobs[id] = j
+
+	return copyJob(j), nil
+}
+
+func (s *MemoryStore) List(f Filter) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := []*Job{}
+	for _, j := range s.jobs {
+		if f.matches(j) {
+			jobs = append(jobs, copyJob(j))
+		}
+	}
+
+	return sortAndLimit(jobs, f), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// copyJob deep copies j so callers can't modify the stored job.
+func copyJob(j *Job) *Job {
+	b, _ := json.Marshal(j)
+
+	c := new(Job)
+	json.Unmarshal(b, c)
+
+	return c
+}
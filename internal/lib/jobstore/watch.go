@@ -0,0 +1,67 @@
+package jobstore
+
+import "sync"
+
+var watchers = struct {
+	sync.Mutex
+	chans map[string]map[chan *Job]bool
+}{chans: map[string]map[chan *Job]bool{}}
+
+// watchedStore notifies watchers of every job it updates.
+type watchedStore struct {
+	Store
+}
+
+func (s *watchedStore) Update(id string, fn func(j *Job)) (*Job, error) {
+	j, err := s.Store.Update(id, fn)
+	if err == nil {
+		notify(j)
+	}
+
+	return j, err
+}
+
+// Watch returns a channel that receives the job after every update. Slow
+// readers only get the latest update. The returned func stops the watch.
+func Watch(id string) (<-chan *Job, func()) {
+	watchers.Lock()
+	defer watchers.Unlock()
+
+	ch := make(chan *Job, 1)
+
+	if watchers.chans[id] == nil {
+		watchers.chans[id] = map[chan *Job]bool{}
+	}
+
+	watchers.chans[id][ch] = true
+
+	return ch, func() {
+		watchers.Lock()
+		defer watchers.Unlock()
+
+		delete(watchers.chans[id], ch)
+
+		if len(watchers.chans[id]) == 0 {
+			delete(watchers.chans, id)
+		}
+	}
+}
+
+func notify(j *Job) {
+	watchers.Lock()
+	defer watchers.Unlock()
+
+	for ch := range watchers.chans[j.Id] {
+		select {
+		case ch <- j:
+		default:
+			// Replace the update the reader hasn't taken yet.
+			select {
+			case <-ch:
+			default:
+			}
+
+			ch <- j
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package manifest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+const (
+	hlsSubtitleGroup = "subs"
+	dashTextMimeType = "text/vtt"
+)
+
+type TextTrack struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	// File is the WebVTT file path relative to the manifest directory.
+	File string `json:"file"`
+}
+
+// AddDashTextTracks adds a WebVTT AdaptationSet for every track to the first
+// Period of the MPD at mpdPath.
+func AddDashTextTracks(mpdPath string, tracks []TextTrack) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	b, err := os.ReadFile(mpdPath)
+	if err != nil {
+		logger.Error("Unable to read DASH manifest %q: %v", mpdPath, err)
+		return err
+	}
+
+	mpd := string(b)
+
+	// A job resumed after a crash may have added the tracks already.
+	if strings.Contains(mpd, fmt.Sprintf("mimeType=\"%s\"", dashTextMimeType)) {
+		logger.Info("DASH manifest %q already has text tracks", mpdPath)
+		return nil
+	}
+
+	i := strings.Index(mpd, "</Period>")
+	if i == -1 {
+		return fmt.Errorf("no Period found in DASH manifest %q", mpdPath)
+	}
+
+	var sets strings.Builder
+	for n, t := range tracks {
+		fmt.Fprintf(&sets, "\t\t<AdaptationSet contentType=\"text\" mimeType=\"%s\" lang=\"%s\">\n", dashTextMimeType, xmlEscape(t.Language))
+		sets.WriteString("\t\t\t<Role schemeIdUri=\"urn:mpeg:dash:role:2011\" value=\"subtitle\"/>\n")
+		fmt.Fprintf(&sets, "\t\t\t<Representation id=\"subtitle_%d\" bandwidth=\"256\">\n", n)
+		fmt.Fprintf(&sets, "\t\t\t\t<BaseURL>%s</BaseURL>\n", xmlEscape(t.File))
+		sets.WriteString("\t\t\t</Representation>\n")
+		sets.WriteString("\t\t</AdaptationSet>\n")
+	}
+
+	mpd = mpd[:i] + sets.String() + "\t" + mpd[i:]
+
+	if err := os.WriteFile(mpdPath, []byte(mpd), 0644); err != nil {
+		logger.Error("Unable to write DASH manifest %q: %v", mpdPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// AddHLSSubtitleTracks writes a single segment media playlist next to every
+// WebVTT file and references them as a SUBTITLES group in the master playlist.
+func AddHLSSubtitleTracks(masterPath string, tracks []TextTrack, durationSeconds float64) error {
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	b, err := os.ReadFile(masterPath)
+	if err != nil {
+		logger.Error("Unable to read HLS master playlist %q: %v", masterPath, err)
+		return err
+	}
+
+	// A job resumed after a crash may have added the group already.
+	if strings.Contains(string(b), fmt.Sprintf("GROUP-ID=\"%s\"", hlsSubtitleGroup)) {
+		logger.Info("HLS master playlist %q already has subtitle tracks", masterPath)
+		return nil
+	}
+
+	dir := path.Dir(masterPath)
+
+	var media strings.Builder
+	for n, t := range tracks {
+		playlist := strings.TrimSuffix(t.File, path.Ext(t.File)) + ".m3u8"
+
+		err := os.WriteFile(path.Join(dir, playlist), []byte(subtitlePlaylist(path.Base(t.File), durationSeconds)), 0644)
+		if err != nil {
+			logger.Error("Unable to write subtitle playlist %q: %v", playlist, err)
+			return err
+		}
+
+		def := "NO"
+		if n == 0 {
+			def = "YES"
+		}
+
+		fmt.Fprintf(&media,
+			"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s\"\n",
+			hlsSubtitleGroup, hlsQuotedString(t.Name), hlsQuotedString(t.Language), def, playlist,
+		)
+	}
+
+	var out strings.Builder
+	inserted := false
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !inserted {
+				out.WriteString(media.String())
+				inserted = true
+			}
+
+			line = strings.TrimRight(line, "\n") + fmt.Sprintf(",SUBTITLES=\"%s\"\n", hlsSubtitleGroup)
+		}
+
+		out.WriteString(line)
+	}
+
+	if !inserted {
+		return fmt.Errorf("no variant streams found in HLS master playlist %q", masterPath)
+	}
+
+	if err := os.WriteFile(masterPath, []byte(out.String()), 0644); err != nil {
+		logger.Error("Unable to write HLS master playlist %q: %v", masterPath, err)
+		return err
+	}
+
+	return nil
+}
+
+func subtitlePlaylist(file string, durationSeconds float64) string {
+	return fmt.Sprintf(
+		"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(durationSeconds)), durationSeconds, file,
+	)
+}
+
+// hlsQuotedString drops the characters an HLS quoted-string can't contain,
+// so a track name can't end the attribute or add lines to the playlist.
+func hlsQuotedString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\r' || r == '\n' {
+			return -1
+		}
+
+		return r
+	}, s)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
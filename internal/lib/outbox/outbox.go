@@ -0,0 +1,271 @@
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/helper"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/prometheus"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/publisher"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var eventsBucket = []byte("events")
+
+// maxRetryDelay caps the delay between relay attempts of a failing event.
+const maxRetryDelay = 10 * time.Minute
+
+var (
+	db   *bolt.DB
+	wake = make(chan struct{}, 1)
+)
+
+// Event is a message waiting to be published.
+type Event struct {
+	// MessageId stays the same across relay attempts so consumers can
+	// deduplicate an event published more than once.
+	MessageId string          `json:"message_id"`
+	Key       string          `json:"key"`
+	Data      json.RawMessage `json:"data"`
+	// TraceContext carries the trace of the job that added the event.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Attempts     int               `json:"attempts"`
+	LastError    string            `json:"last_error,omitempty"`
+	// NextAttemptAt delays the next relay of an event that failed.
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+func Init(p string) error {
+	var err error
+
+	db, err = bolt.Open(p, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		logger.Error("Unable to open outbox %q: %v", p, err)
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(eventsBucket)
+		if err == nil {
+			prometheus.OutboxPendingEvents.Set(float64(b.Stats().KeyN))
+		}
+
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	logger.Info("Using outbox %q", p)
+
+	return nil
+}
+
+func Close() error {
+	return db.Close()
+}
+
+// Add durably stores the message so the relay publishes it at least once,
+// even when the process dies before it could.
+func Add(ctx context.Context, key string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	e := &Event{
+		MessageId:    helper.UniqueString(26),
+		Key:          key,
+		Data:         b,
+		TraceContext: carrier,
+		CreatedAt:    time.Now(),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(eventKey(seq), v)
+	})
+	if err != nil {
+		logger.Error("Unable to add %q event to outbox: %v", key, err)
+		return err
+	}
+
+	prometheus.OutboxPendingEvents.Inc()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Relay publishes the stored events in the order they were added, every
+// interval and whenever an event is added, until ctx is done. An event is
+// only removed once the broker confirmed it. An event that fails, e.g.
+// because no queue is bound to its key, is retried with a growing delay while
+// the events after it keep being relayed.
+func Relay(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		relayPending(ctx, interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-wake:
+		}
+	}
+}
+
+func relayPending(ctx context.Context, interval time.Duration) {
+	keys, err := pendingKeys()
+	if err != nil {
+		logger.Error("Unable to read outbox: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil || !publisher.P.Connected() {
+			return
+		}
+
+		e, err := get(key)
+		if err != nil {
+			logger.Error("Dropping malformed outbox event: %v", err)
+
+			if err := remove(key); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if e == nil || time.Now().Before(e.NextAttemptAt) {
+			continue
+		}
+
+		eventCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(e.TraceContext))
+
+		err = publisher.P.Publish(eventCtx, &publisher.MessageType{MessageId: e.MessageId, Key: e.Key, Data: e.Data})
+		if errors.Is(err, publisher.ErrNotConnected) {
+			return
+		}
+
+		if err != nil {
+			e.Attempts++
+			e.LastError = err.Error()
+			e.NextAttemptAt = time.Now().Add(retryDelay(interval, e.Attempts))
+
+			logger.Warn("Outbox event %q not published after %d rounds, retrying at %v: %v", e.Key, e.Attempts, e.NextAttemptAt, err)
+
+			put(key, e)
+
+			continue
+		}
+
+		if err := remove(key); err != nil {
+			logger.Error("Unable to remove published %q event from outbox: %v", e.Key, err)
+			return
+		}
+	}
+}
+
+// retryDelay doubles the relay interval with every failed round of an event.
+func retryDelay(interval time.Duration, attempts int) time.Duration {
+	delay := interval
+
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxRetryDelay)
+}
+
+// pendingKeys returns the keys of the stored events in the order they were
+// added.
+func pendingKeys() ([][]byte, error) {
+	keys := [][]byte{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+// get returns the event stored under key, nil when it was removed meanwhile.
+func get(key []byte) (*Event, error) {
+	var e *Event
+
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(eventsBucket).Get(key)
+		if v == nil {
+			return nil
+		}
+
+		e = new(Event)
+
+		return json.Unmarshal(v, e)
+	})
+
+	return e, err
+}
+
+func put(key []byte, e *Event) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).Put(key, v)
+	})
+}
+
+func remove(key []byte) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).Delete(key)
+	})
+	if err == nil {
+		prometheus.OutboxPendingEvents.Dec()
+	}
+
+	return err
+}
+
+// eventKey encodes seq big endian so the keys sort in insertion order.
+func eventKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+
+	return k
+}
@@ -15,7 +15,7 @@ var (
 			Name: "messages_total",
 			Help: "Total number of messages received from RabbitMQ",
 		},
-		[]string{"message_type"},
+		[]string{"message_type", "priority"},
 	)
 
 	MessageProcessingDuration = prometheuslib.NewHistogramVec(
@@ -24,7 +24,7 @@ var (
 			Help:    "Time taken to process each message.",
 			Buckets: prometheuslib.DefBuckets,
 		},
-		[]string{"message_type"},
+		[]string{"message_type", "priority"},
 	)
 
 	MessageProcessingErrorsCounter = prometheuslib.NewCounterVec(
@@ -32,9 +32,22 @@ var (
 			Name: "message_processing_errors_total",
 			Help: "Total number of message processing failures.",
 		},
-		[]string{"message_type", "reason"},
+		[]string{"message_type", "priority", "reason"},
 	)
 
+	HandlerPanicsCounter = prometheuslib.NewCounterVec(
+		prometheuslib.CounterOpts{
+			Name: "handler_panics_total",
+			Help: "Total number of panics recovered while processing messages.",
+		},
+		[]string{"message_type"},
+	)
+
+	OutboxPendingEvents = prometheuslib.NewGauge(prometheuslib.GaugeOpts{
+		Name: "outbox_pending_events",
+		Help: "Number of events in the outbox waiting to be published.",
+	})
+
 	ServiceHealth = prometheuslib.NewGauge(prometheuslib.GaugeOpts{
 		Name: "service_health_status",
 		Help: "Health status of the service: 1=Healthy, 0=Unhealthy",
@@ -46,6 +59,8 @@ func NewServer() *http.Server {
 		TotalMessagesCounter,
 		MessageProcessingDuration,
 		MessageProcessingErrorsCounter,
+		HandlerPanicsCounter,
+		OutboxPendingEvents,
 		ServiceHealth,
 	)
 
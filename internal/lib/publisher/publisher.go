@@ -3,29 +3,56 @@ package publisher
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	amqplib "github.com/rabbitmq/amqp091-go"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/helper"
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var P *Publisher
+var (
+	ErrNacked       = errors.New("message was nacked by the broker")
+	ErrUnroutable   = errors.New("message couldn't be routed to any queue")
+	ErrNotConnected = errors.New("publisher has no open channel")
+)
+
+// P outlives reconnects, Init only swaps the channel it publishes on.
+var P = new(Publisher)
 
+// Publisher publishes mandatory messages on a channel in confirm mode.
+// Publishes are serialized so the returns read after a confirm belong to
+// messages of this publisher that are already confirmed.
 type Publisher struct {
+	mu      sync.Mutex
 	channel *amqplib.Channel
+	returns chan amqplib.Return
 }
 
+// MessageType is the envelope of every published message. Publish fills in
+// the current schema version and a new message id when they're not set.
 type MessageType struct {
-	Key  string `json:"key"`
-	Data any    `json:"data"`
+	SchemaVersion int    `json:"schema_version"`
+	MessageId     string `json:"message_id"`
+	Key           string `json:"key"`
+	Data          any    `json:"data"`
+	// Priority is the AMQP priority the message is published with.
+	Priority uint8 `json:"-"`
 }
 
-func (p *Publisher) Publish(ctx context.Context, queue string, message *MessageType) error {
+// Publish sends the message to the configured exchange with its key as the
+// routing key and waits until the broker confirmed it. Messages that are
+// nacked, unroutable or not confirmed in time are retried.
+func (p *Publisher) Publish(ctx context.Context, message *MessageType) error {
 	tracer := otel.Tracer(constant.ServiceName)
 	ctx, span := tracer.Start(ctx, constant.TraceTypeRabbitMQPublish)
 	span.SetAttributes(attribute.String("message_key", message.Key))
@@ -33,15 +60,15 @@ func (p *Publisher) Publish(ctx context.Context, queue string, message *MessageT
 
 	c := config.Conf.AMQP
 
-	q, err := p.declareQueue(queue)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "failed to declare queue")
-		return err
+	if message.SchemaVersion == 0 {
+		message.SchemaVersion = constant.MessageSchemaVersion
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, c.PublishTimeoutSeconds)
-	defer cancel()
+	if message.MessageId == "" {
+		message.MessageId = helper.UniqueString(26)
+	}
+
+	span.SetAttributes(attribute.String("message_id", message.MessageId))
 
 	messageData, err := json.Marshal(&message)
 	if err != nil {
@@ -59,23 +86,38 @@ func (p *Publisher) Publish(ctx context.Context, queue string, message *MessageT
 		headers[k] = v
 	}
 
-	err = p.channel.PublishWithContext(
-		ctx,
-		"",
-		q.Name,
-		false,
-		false,
-		amqplib.Publishing{
-			ContentType: constant.ContentTypeJSON,
-			Body:        messageData,
-			Headers:     headers,
-		},
-	)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "failed to publish message")
-		logger.Error("AMQP Unable to publish message %v", err)
-		return err
+	publishing := amqplib.Publishing{
+		ContentType:  constant.ContentTypeJSON,
+		DeliveryMode: amqplib.Persistent,
+		MessageId:    message.MessageId,
+		Priority:     message.Priority,
+		Body:         messageData,
+		Headers:      headers,
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = p.publish(ctx, message.Key, publishing)
+		if err == nil {
+			break
+		}
+
+		span.AddEvent("publish attempt failed", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+		logger.Warn("AMQP publish attempt %d of message %q failed: %v", attempt, message.Key, err)
+
+		if attempt >= c.PublishRetryAttempts || ctx.Err() != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to publish message")
+			logger.Error("AMQP Unable to publish message %v", err)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.PublishRetryIntervalSeconds * time.Duration(attempt)):
+		}
 	}
 
 	span.SetStatus(codes.Ok, "message published")
@@ -84,25 +126,95 @@ func (p *Publisher) Publish(ctx context.Context, queue string, message *MessageT
 	return nil
 }
 
-func (p *Publisher) declareQueue(queue string) (*amqplib.Queue, error) {
-	q, err := p.channel.QueueDeclare(
-		queue,
+// publish makes one attempt at publishing and waiting for the confirm.
+func (p *Publisher) publish(ctx context.Context, routingKey string, publishing amqplib.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil || p.channel.IsClosed() {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Conf.AMQP.PublishTimeoutSeconds)
+	defer cancel()
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(
+		ctx,
+		config.Conf.AMQP.Exchange,
+		routingKey,
 		true,
 		false,
-		false,
-		false,
-		nil,
+		publishing,
 	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+
+	// The broker sends the return of an unroutable message before its
+	// confirm, so it's already queued by now.
+	returned := p.drainReturns(publishing.MessageId)
 
 	if err != nil {
-		logger.Error("Declare queue error %v", err)
+		return fmt.Errorf("waiting for confirm: %w", err)
+	}
+
+	if !acked {
+		return ErrNacked
+	}
 
-		return nil, err
+	if returned != nil {
+		return fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)
 	}
 
-	return &q, err
+	return nil
 }
 
-func Init(channel *amqplib.Channel) {
-	P = &Publisher{channel: channel}
+// drainReturns empties the returns channel and returns the return of the
+// message with messageId, if any.
+func (p *Publisher) drainReturns(messageId string) *amqplib.Return {
+	var returned *amqplib.Return
+
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				return returned
+			}
+
+			if r.MessageId == messageId {
+				returned = &r
+			}
+		default:
+			return returned
+		}
+	}
+}
+
+// Connected reports whether the publisher has a channel to publish on.
+func (p *Publisher) Connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.channel != nil && !p.channel.IsClosed()
+}
+
+// Init puts the channel in confirm mode and makes P publish on it. A publish
+// in progress finishes on the previous channel first.
+func Init(channel *amqplib.Channel) error {
+	if err := channel.Confirm(false); err != nil {
+		logger.Error("AMQP unable to put publisher channel in confirm mode %v", err)
+		return err
+	}
+
+	returns := channel.NotifyReturn(make(chan amqplib.Return, 16))
+
+	P.mu.Lock()
+	defer P.mu.Unlock()
+
+	P.channel = channel
+	P.returns = returns
+
+	return nil
 }
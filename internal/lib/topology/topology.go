@@ -0,0 +1,236 @@
+package topology
+
+import (
+	"fmt"
+	"strings"
+
+	amqplib "github.com/rabbitmq/amqp091-go"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/config"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/constant"
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+type Exchange struct {
+	Name string
+	Kind string
+}
+
+type Queue struct {
+	Name string
+	Args amqplib.Table
+}
+
+type Binding struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+}
+
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+// FromConfig builds the exchanges, queues and bindings of the service. The
+// queues the service consumes get the configured arguments; other queues in
+// the bindings, like the ones of downstream services, are declared plain.
+func FromConfig(c *config.AMQP) (*Topology, error) {
+	t := &Topology{
+		Exchanges: []Exchange{{Name: c.Exchange, Kind: c.ExchangeType}},
+	}
+
+	args := queueArgs(c)
+	declared := map[string]bool{}
+
+	for _, q := range []string{constant.QueueEncodeService, constant.QueueEncodeServiceControl} {
+		t.Queues = append(t.Queues, Queue{Name: q, Args: args})
+		declared[q] = true
+	}
+
+	if c.DeadLetterExchange != "" {
+		deadLetterQueue := constant.QueueEncodeService + ".dead-letter"
+
+		t.Exchanges = append(t.Exchanges, Exchange{Name: c.DeadLetterExchange, Kind: amqplib.ExchangeTopic})
+		t.Queues = append(t.Queues, Queue{Name: deadLetterQueue})
+		t.Bindings = append(t.Bindings, Binding{Queue: deadLetterQueue, Exchange: c.DeadLetterExchange, RoutingKey: "#"})
+		declared[deadLetterQueue] = true
+	}
+
+	bindings, err := ParseBindings(c.Bindings, c.Exchange)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range bindings {
+		if !declared[b.Queue] {
+			t.Queues = append(t.Queues, Queue{Name: b.Queue})
+			declared[b.Queue] = true
+		}
+	}
+
+	t.Bindings = append(t.Bindings, bindings...)
+
+	return t, nil
+}
+
+// ParseBindings parses comma separated "queue=routing key" pairs into
+// bindings to exchange.
+func ParseBindings(s string, exchange string) ([]Binding, error) {
+	bindings := []Binding{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		queue, key, ok := strings.Cut(pair, "=")
+		if !ok || queue == "" || key == "" {
+			return nil, fmt.Errorf("invalid binding %q, expected queue=routing key", pair)
+		}
+
+		bindings = append(bindings, Binding{Queue: queue, Exchange: exchange, RoutingKey: key})
+	}
+
+	return bindings, nil
+}
+
+func queueArgs(c *config.AMQP) amqplib.Table {
+	args := amqplib.Table{}
+
+	if c.QueueType != "" {
+		args[amqplib.QueueTypeArg] = c.QueueType
+	}
+
+	if c.QueueMessageTTLSeconds > 0 {
+		args[amqplib.QueueMessageTTLArg] = c.QueueMessageTTLSeconds.Milliseconds()
+	}
+
+	if c.QueueMaxLength > 0 {
+		args[amqplib.QueueMaxLenArg] = c.QueueMaxLength
+	}
+
+	if c.QueueOverflow != "" {
+		args[amqplib.QueueOverflowArg] = c.QueueOverflow
+	}
+
+	if c.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = c.DeadLetterExchange
+	}
+
+	if c.QueueMaxPriority > 0 {
+		if c.QueueType == amqplib.QueueTypeQuorum {
+			logger.Warn("Quorum queues don't support x-max-priority, ignoring AMQP_QUEUE_MAX_PRIORITY")
+		} else {
+			args["x-max-priority"] = c.QueueMaxPriority
+		}
+	}
+
+	return args
+}
+
+// Declare declares t on ch. A failed declaration closes the channel, so ch
+// should be one used only for this.
+func Declare(ch *amqplib.Channel, t *Topology) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.Kind, true, false, false, false, nil); err != nil {
+			logger.Error("AMQP declare exchange %q error %v", e.Name, err)
+			return err
+		}
+	}
+
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, true, false, false, false, q.Args); err != nil {
+			logger.Error("AMQP declare queue %q error %v", q.Name, err)
+			return err
+		}
+	}
+
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil); err != nil {
+			logger.Error("AMQP bind queue %q to %q with %q error %v", b.Queue, b.Exchange, b.RoutingKey, err)
+			return err
+		}
+	}
+
+	logger.Info("AMQP declared %d exchanges, %d queues and %d bindings", len(t.Exchanges), len(t.Queues), len(t.Bindings))
+
+	return nil
+}
+
+// publishedKeys are the routing keys of the events the service publishes.
+var publishedKeys = []string{
+	constant.MessageTypeVideoEncodingCompleted,
+	constant.MessageTypeVideoEncodingCancelled,
+	constant.MessageTypeVideoEncodingFailed,
+	constant.MessageTypeVideoEncodingUpdated,
+}
+
+// UnboundKeys returns the routing keys of the events the service publishes to
+// exchange that no binding of t routes to a queue. The broker returns such
+// events, so they stay in the outbox.
+func (t *Topology) UnboundKeys(exchange string) []string {
+	kind := ""
+	for _, e := range t.Exchanges {
+		if e.Name == exchange {
+			kind = e.Kind
+		}
+	}
+
+	unbound := []string{}
+
+	for _, key := range publishedKeys {
+		bound := false
+
+		for _, b := range t.Bindings {
+			if b.Exchange == exchange && routes(kind, b.RoutingKey, key) {
+				bound = true
+				break
+			}
+		}
+
+		if !bound {
+			unbound = append(unbound, key)
+		}
+	}
+
+	return unbound
+}
+
+// routes reports whether an exchange of kind routes key through a binding
+// with bindingKey.
+func routes(kind string, bindingKey string, key string) bool {
+	switch kind {
+	case amqplib.ExchangeFanout:
+		return true
+	case amqplib.ExchangeTopic:
+		return matchTopic(strings.Split(bindingKey, "."), strings.Split(key, "."))
+	default:
+		return bindingKey == key
+	}
+}
+
+// matchTopic matches the words of a routing key against the words of a topic
+// binding key, where * matches one word and # zero or more.
+func matchTopic(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(words) == 0 {
+		return false
+	}
+
+	return (pattern[0] == "*" || pattern[0] == words[0]) && matchTopic(pattern[1:], words[1:])
+}
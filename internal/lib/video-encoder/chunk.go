@@ -0,0 +1,87 @@
+package video_encoder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	ffmpeglib "github.com/u2takey/ffmpeg-go"
+)
+
+const chunkFilePattern = "chunk_%05d.mkv"
+
+// SplitVideo cuts the video stream of the source into chunks of roughly
+// segmentSeconds without re-encoding. The segment muxer only cuts on
+// keyframes, so every chunk can be decoded on its own.
+func SplitVideo(ctx context.Context, in string, outDir string, segmentSeconds int) ([]string, error) {
+	err := run(ctx, ffmpeglib.Input(in).
+		Get("v:0").
+		Output(path.Join(outDir, chunkFilePattern), ffmpeglib.KwArgs{
+			"c":                "copy",
+			"f":                "segment",
+			"segment_time":     segmentSeconds,
+			"reset_timestamps": 1,
+		}))
+	if err != nil {
+		logger.Error("FFMPEG split video failed %v", err)
+		return nil, err
+	}
+
+	chunks, err := filepath.Glob(path.Join(outDir, "chunk_*.mkv"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(chunks)
+
+	return chunks, nil
+}
+
+// ConcatVideos joins encoded chunks with the concat demuxer without
+// re-encoding them.
+func ConcatVideos(ctx context.Context, chunks []string, out string) error {
+	var list strings.Builder
+	for _, c := range chunks {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(c, "'", `'\''`))
+	}
+
+	listPath := out + ".txt"
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		logger.Error("Unable to write concat list %q: %v", listPath, err)
+		return err
+	}
+
+	err := run(ctx, ffmpeglib.Input(listPath, ffmpeglib.KwArgs{"f": "concat", "safe": 0}).
+		Output(out, ffmpeglib.KwArgs{"c": "copy"}))
+	if err != nil {
+		logger.Error("FFMPEG concat videos failed %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// MuxAudio copies the video of videoPath and encodes the audio of audioPath
+// into out. Audio is encoded in one pass over the whole source since AAC
+// priming samples would leave gaps at chunk boundaries.
+func MuxAudio(ctx context.Context, videoPath string, audioPath string, out string, audioCodec string, audioBitRate string) error {
+	video := ffmpeglib.Input(videoPath).Get("v:0")
+	audio := ffmpeglib.Input(audioPath).Get("a:0?")
+
+	err := run(ctx, ffmpeglib.Output([]*ffmpeglib.Stream{video, audio}, out, ffmpeglib.KwArgs{
+		"c:v": "copy",
+		"c:a": audioCodec,
+		"b:a": audioBitRate,
+	}))
+	if err != nil {
+		logger.Error("FFMPEG mux audio failed %v", err)
+		return err
+	}
+
+	return nil
+}
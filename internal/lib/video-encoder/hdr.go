@@ -0,0 +1,170 @@
+package video_encoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	ffmpeglib "github.com/u2takey/ffmpeg-go"
+)
+
+const (
+	ColorTransferPQ  = "smpte2084"
+	ColorTransferHLG = "arib-std-b67"
+)
+
+const hdrPixelFormat = "yuv420p10le"
+
+// HDRMetadata is the static HDR10 metadata carried in the frame side data.
+// Chromaticities are CIE 1931 xy coordinates and luminance is in cd/m2.
+type HDRMetadata struct {
+	HasMasteringDisplay bool
+	RedX, RedY          float64
+	GreenX, GreenY      float64
+	BlueX, BlueY        float64
+	WhitePointX         float64
+	WhitePointY         float64
+	MinLuminance        float64
+	MaxLuminance        float64
+	MaxContentLight     int
+	MaxAverageLight     int
+}
+
+func (v *VideoInfo) IsHDR() bool {
+	return v.ColorTransfer == ColorTransferPQ || v.ColorTransfer == ColorTransferHLG
+}
+
+// GetHDRMetadata reads the mastering display and content light level side data
+// from the first frame of the video.
+func GetHDRMetadata(in string) (*HDRMetadata, error) {
+	args := []string{
+		"-v",
+		"error",
+		"-select_streams",
+		"v:0",
+		"-read_intervals",
+		"%+#1",
+		"-show_entries",
+		"frame=side_data_list",
+		"-of",
+		"json",
+		in,
+	}
+
+	o, err := exec.Command("ffprobe", args...).Output()
+	if err != nil {
+		logger.Error("FFprobe command failed %v", err)
+		return nil, err
+	}
+
+	type SideData struct {
+		Type         string `json:"side_data_type"`
+		RedX         string `json:"red_x"`
+		RedY         string `json:"red_y"`
+		GreenX       string `json:"green_x"`
+		GreenY       string `json:"green_y"`
+		BlueX        string `json:"blue_x"`
+		BlueY        string `json:"blue_y"`
+		WhitePointX  string `json:"white_point_x"`
+		WhitePointY  string `json:"white_point_y"`
+		MinLuminance string `json:"min_luminance"`
+		MaxLuminance string `json:"max_luminance"`
+		MaxContent   int    `json:"max_content"`
+		MaxAverage   int    `json:"max_average"`
+	}
+
+	type FileOutput struct {
+		Frames []struct {
+			SideDataList []SideData `json:"side_data_list"`
+		} `json:"frames"`
+	}
+
+	m := new(FileOutput)
+	if err := json.Unmarshal(o, m); err != nil {
+		logger.Error("Unable to parse ffprobe output %v", err)
+		return nil, err
+	}
+
+	meta := new(HDRMetadata)
+	if len(m.Frames) == 0 {
+		return meta, nil
+	}
+
+	for _, d := range m.Frames[0].SideDataList {
+		switch d.Type {
+		case "Mastering display metadata":
+			meta.HasMasteringDisplay = true
+			meta.RedX, meta.RedY = parseRatio(d.RedX, "/"), parseRatio(d.RedY, "/")
+			meta.GreenX, meta.GreenY = parseRatio(d.GreenX, "/"), parseRatio(d.GreenY, "/")
+			meta.BlueX, meta.BlueY = parseRatio(d.BlueX, "/"), parseRatio(d.BlueY, "/")
+			meta.WhitePointX, meta.WhitePointY = parseRatio(d.WhitePointX, "/"), parseRatio(d.WhitePointY, "/")
+			meta.MinLuminance, meta.MaxLuminance = parseRatio(d.MinLuminance, "/"), parseRatio(d.MaxLuminance, "/")
+		case "Content light level metadata":
+			meta.MaxContentLight, meta.MaxAverageLight = d.MaxContent, d.MaxAverage
+		}
+	}
+
+	return meta, nil
+}
+
+// ToneMapFilter converts PQ/HLG BT.2020 video to 8-bit BT.709 SDR. It has to
+// run before scaling so the scaler works on SDR pixels.
+func ToneMapFilter() string {
+	return "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+		"tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+}
+
+// HDRPassthroughArgs returns the output options that keep the source color
+// signalling and HDR10 metadata for a 10-bit HEVC or AV1 encode.
+func HDRPassthroughArgs(codec string, info *VideoInfo, meta *HDRMetadata) ffmpeglib.KwArgs {
+	args := ffmpeglib.KwArgs{
+		"pix_fmt":         hdrPixelFormat,
+		"color_primaries": info.ColorPrimaries,
+		"color_trc":       info.ColorTransfer,
+		"colorspace":      info.ColorSpace,
+	}
+
+	switch codec {
+	case "libx265":
+		params := fmt.Sprintf("hdr-opt=1:repeat-headers=1:colorprim=%s:transfer=%s:colormatrix=%s",
+			info.ColorPrimaries, info.ColorTransfer, info.ColorSpace)
+
+		if meta != nil && meta.HasMasteringDisplay {
+			// x265 expects chromaticities in 0.00002 and luminance in 0.0001 units.
+			params += fmt.Sprintf(":master-display=G(%.0f,%.0f)B(%.0f,%.0f)R(%.0f,%.0f)WP(%.0f,%.0f)L(%.0f,%.0f)",
+				meta.GreenX*50000, meta.GreenY*50000, meta.BlueX*50000, meta.BlueY*50000,
+				meta.RedX*50000, meta.RedY*50000, meta.WhitePointX*50000, meta.WhitePointY*50000,
+				meta.MaxLuminance*10000, meta.MinLuminance*10000)
+		}
+
+		if meta != nil && meta.MaxContentLight > 0 {
+			params += fmt.Sprintf(":max-cll=%d,%d", meta.MaxContentLight, meta.MaxAverageLight)
+		}
+
+		args["x265-params"] = params
+		args["tag:v"] = "hvc1"
+	case "libsvtav1":
+		params := ""
+
+		if meta != nil && meta.HasMasteringDisplay {
+			params = fmt.Sprintf("mastering-display=G(%.4f,%.4f)B(%.4f,%.4f)R(%.4f,%.4f)WP(%.4f,%.4f)L(%.4f,%.4f)",
+				meta.GreenX, meta.GreenY, meta.BlueX, meta.BlueY, meta.RedX, meta.RedY,
+				meta.WhitePointX, meta.WhitePointY, meta.MaxLuminance, meta.MinLuminance)
+		}
+
+		if meta != nil && meta.MaxContentLight > 0 {
+			if params != "" {
+				params += ":"
+			}
+
+			params += fmt.Sprintf("content-light=%d,%d", meta.MaxContentLight, meta.MaxAverageLight)
+		}
+
+		if params != "" {
+			args["svtav1-params"] = params
+		}
+	}
+
+	return args
+}
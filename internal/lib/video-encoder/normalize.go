@@ -0,0 +1,153 @@
+package video_encoder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+	ffmpeglib "github.com/u2takey/ffmpeg-go"
+)
+
+type NormalizeVideoArgs struct {
+	VideoFilter  string
+	VideoCodec   string
+	AudioCodec   string
+	AudioBitRate string
+	CRF          int
+	Preset       string
+	ExtraArgs    ffmpeglib.KwArgs
+}
+
+// SampleAspect returns the pixel aspect ratio of the stream, 1 for square
+// pixels or when ffprobe doesn't report one.
+func (v *VideoInfo) SampleAspect() float64 {
+	r := parseRatio(v.SampleAspectRatio, ":")
+	if r <= 0 {
+		return 1
+	}
+
+	return r
+}
+
+// FrameRate returns the average frame rate of the stream, falling back to the
+// real base frame rate when the average is unknown.
+func (v *VideoInfo) FrameRate() float64 {
+	if r := parseRatio(v.AvgFrameRate, "/"); r > 0 {
+		return r
+	}
+
+	return parseRatio(v.RFrameRate, "/")
+}
+
+// IsVariableFrameRate reports whether the base and average frame rates differ
+// by more than 1%, which is how VFR phone recordings show up in ffprobe.
+func (v *VideoInfo) IsVariableFrameRate() bool {
+	r := parseRatio(v.RFrameRate, "/")
+	avg := parseRatio(v.AvgFrameRate, "/")
+
+	if r <= 0 || avg <= 0 {
+		return false
+	}
+
+	return math.Abs(r-avg)/r > 0.01
+}
+
+// NormalizationReasons lists what has to be fixed before the source can be
+// fed to the ladder encode. An empty list means the source is used as is.
+func NormalizationReasons(info *VideoInfo, maxFrameRate float64) []string {
+	reasons := []string{}
+
+	if math.Abs(info.SampleAspect()-1) > 0.001 {
+		reasons = append(reasons, fmt.Sprintf("non-square pixels (SAR %s)", info.SampleAspectRatio))
+	}
+
+	if info.Width%2 != 0 || info.Height%2 != 0 {
+		reasons = append(reasons, fmt.Sprintf("odd dimensions (%dx%d)", info.Width, info.Height))
+	}
+
+	if info.IsVariableFrameRate() {
+		reasons = append(reasons, fmt.Sprintf("variable frame rate (r %s, avg %s)", info.RFrameRate, info.AvgFrameRate))
+	}
+
+	if maxFrameRate > 0 && info.FrameRate() > maxFrameRate {
+		reasons = append(reasons, fmt.Sprintf("frame rate %.2f above %.2f", info.FrameRate(), maxFrameRate))
+	}
+
+	return reasons
+}
+
+// NormalizeFilter converts the source to square pixels, even dimensions and a
+// constant frame rate capped at maxFrameRate.
+func NormalizeFilter(info *VideoInfo, maxFrameRate float64) string {
+	frameRate := info.AvgFrameRate
+	if parseRatio(frameRate, "/") <= 0 {
+		frameRate = info.RFrameRate
+	}
+
+	if maxFrameRate > 0 && info.FrameRate() > maxFrameRate {
+		frameRate = strconv.FormatFloat(maxFrameRate, 'f', -1, 64)
+	}
+
+	filters := []string{
+		"scale=trunc(iw*sar/2)*2:trunc(ih/2)*2",
+		"setsar=1",
+	}
+
+	if parseRatio(frameRate, "/") > 0 {
+		filters = append(filters, fmt.Sprintf("fps=%s", frameRate))
+	}
+
+	return strings.Join(filters, ",")
+}
+
+// NormalizeVideo writes a high quality mezzanine of the source with a constant
+// frame rate. Audio is resampled against the timestamps so it stays in sync
+// after frames are dropped or duplicated.
+func NormalizeVideo(ctx context.Context, in string, out string, args *NormalizeVideoArgs) error {
+	outArgs := ffmpeglib.KwArgs{
+		"c:v":      args.VideoCodec,
+		"crf":      args.CRF,
+		"preset":   args.Preset,
+		"vf":       args.VideoFilter,
+		"fps_mode": "cfr",
+		"c:a":      args.AudioCodec,
+		"b:a":      args.AudioBitRate,
+		"af":       "aresample=async=1:first_pts=0",
+		"sn":       "",
+	}
+
+	for k, v := range args.ExtraArgs {
+		outArgs[k] = v
+	}
+
+	err := run(ctx, ffmpeglib.Input(in).
+		Output(out, outArgs))
+	if err != nil {
+		logger.Error("FFMPEG normalize video failed %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func parseRatio(s string, sep string) float64 {
+	num, den, ok := strings.Cut(s, sep)
+	if !ok {
+		return 0
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
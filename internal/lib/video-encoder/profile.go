@@ -0,0 +1,41 @@
+package video_encoder
+
+const (
+	HDRModeToneMap     = "tonemap"
+	HDRModePassthrough = "passthrough"
+)
+
+const DefaultProfile = "default"
+
+// EncodeProfile decides how sources are encoded on top of the rendition
+// ladder in VideoEncodeOptions. SDR sources are encoded the same way by every
+// profile; HDR sources are either tone mapped to SDR or encoded with
+// HDRVideoCodec keeping their color metadata.
+type EncodeProfile struct {
+	Name          string
+	HDRMode       string
+	HDRVideoCodec string
+}
+
+var EncodeProfiles = map[string]*EncodeProfile{
+	DefaultProfile: {
+		Name:    DefaultProfile,
+		HDRMode: HDRModeToneMap,
+	},
+	"hdr-hevc": {
+		Name:          "hdr-hevc",
+		HDRMode:       HDRModePassthrough,
+		HDRVideoCodec: "libx265",
+	},
+	"hdr-av1": {
+		Name:          "hdr-av1",
+		HDRMode:       HDRModePassthrough,
+		HDRVideoCodec: "libsvtav1",
+	},
+}
+
+func GetEncodeProfile(name string) (*EncodeProfile, bool) {
+	p, ok := EncodeProfiles[name]
+
+	return p, ok
+}
@@ -1,20 +1,28 @@
 package video_encoder
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
 	ffmpeglib "github.com/u2takey/ffmpeg-go"
 )
 
+var ErrNoVideoStream = errors.New("no video stream found")
+
 type EncodeVideoToResolutionArgs struct {
 	VideoCodec   string
 	AudioCodec   string
-	Resolution   string
+	VideoFilter  string
 	AudioBitRate string
 	VideoBitRate string
+	// ExtraArgs are codec specific options merged into the output arguments.
+	ExtraArgs ffmpeglib.KwArgs
 }
 
 type EncodeVideoToDashArgs struct {
@@ -22,14 +30,53 @@ type EncodeVideoToDashArgs struct {
 	SegmentDuration int
 	UseTimeline     int
 	UseTemplate     int
+	HLSPlaylist     int
 }
 
 type VideoInfo struct {
+	CodecName      string `json:"codec_name"`
+	BitRate        string `json:"bit_rate"`
+	Height         int    `json:"height"`
+	Width          int    `json:"width"`
+	Duration       string `json:"duration"`
+	ClosedCaptions int    `json:"closed_captions"`
+	// Aspect ratios are "num:den" and frame rates "num/den" strings.
+	SampleAspectRatio  string `json:"sample_aspect_ratio"`
+	DisplayAspectRatio string `json:"display_aspect_ratio"`
+	RFrameRate         string `json:"r_frame_rate"`
+	AvgFrameRate       string `json:"avg_frame_rate"`
+	PixelFormat        string `json:"pix_fmt"`
+	ColorTransfer      string `json:"color_transfer"`
+	ColorPrimaries     string `json:"color_primaries"`
+	ColorSpace         string `json:"color_space"`
+	Tags               struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		Rotation int `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+type SubtitleStreamInfo struct {
+	Index     int    `json:"index"`
 	CodecName string `json:"codec_name"`
-	BitRate   string `json:"bit_rate"`
-	Height    int    `json:"height"`
-	Width     int    `json:"width"`
-	Duration  string `json:"duration"`
+	Tags      struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+	} `json:"tags"`
+}
+
+// Subtitle codecs that ffmpeg can convert to WebVTT. Bitmap based subtitles
+// (PGS, VobSub, DVB) need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"mov_text": true,
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"webvtt":   true,
+	"text":     true,
+	"eia_608":  true,
 }
 
 type VideoEncodeOption struct {
@@ -96,20 +143,21 @@ var VideoEncodeOptions = []VideoEncodeOption{
 	},
 }
 
-func EncodeVideoToResolution(inPath string, outPath string, args *EncodeVideoToResolutionArgs) error {
+func EncodeVideoToResolution(ctx context.Context, inPath string, outPath string, args *EncodeVideoToResolutionArgs) error {
 	outArgs := ffmpeglib.KwArgs{
 		"c:v": args.VideoCodec,
-		"vf":  fmt.Sprintf("scale=%s", args.Resolution),
+		"vf":  args.VideoFilter,
 		"b:a": args.AudioBitRate,
 		"b:v": args.VideoBitRate,
 		"c:a": args.AudioCodec,
 	}
 
-	err := ffmpeglib.Input(inPath).
-		Output(outPath, outArgs).
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
+	for k, v := range args.ExtraArgs {
+		outArgs[k] = v
+	}
+
+	err := run(ctx, ffmpeglib.Input(inPath).
+		Output(outPath, outArgs))
 	if err != nil {
 		logger.Error("FFMPEG encode video to resolution failed %v", err)
 		return err
@@ -118,22 +166,148 @@ func EncodeVideoToResolution(inPath string, outPath string, args *EncodeVideoToR
 	return nil
 }
 
-func EncodeVideoToDash(in string, out string, args *EncodeVideoToDashArgs) error {
+// RenditionOutput is one output of EncodeVideoToResolutions.
+type RenditionOutput struct {
+	Path string
+	Args *EncodeVideoToResolutionArgs
+}
+
+// EncodeVideoToResolutions decodes the source once and encodes every output
+// from its own branch of a split of the video stream.
+func EncodeVideoToResolutions(ctx context.Context, inPath string, outputs []RenditionOutput) error {
+	input := ffmpeglib.Input(inPath)
+	split := input.Get("v:0").Split()
+
+	streams := []*ffmpeglib.Stream{}
+	for i, o := range outputs {
+		video := applyFilterChain(split.Get(strconv.Itoa(i)), o.Args.VideoFilter)
+
+		outArgs := ffmpeglib.KwArgs{
+			"c:v": o.Args.VideoCodec,
+			"b:a": o.Args.AudioBitRate,
+			"b:v": o.Args.VideoBitRate,
+			"c:a": o.Args.AudioCodec,
+		}
+
+		for k, v := range o.Args.ExtraArgs {
+			outArgs[k] = v
+		}
+
+		streams = append(streams, ffmpeglib.Output([]*ffmpeglib.Stream{video, input.Get("a:0?")}, o.Path, outArgs))
+	}
+
+	err := run(ctx, ffmpeglib.MergeOutputs(streams...))
+	if err != nil {
+		logger.Error("FFMPEG encode video to resolutions failed %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// EncodeVideoToDashDirect decodes the source once and muxes every encoded
+// rendition straight into the DASH output without intermediate files. The
+// audio is encoded once with the codec and bitrate of the first rendition.
+func EncodeVideoToDashDirect(ctx context.Context, inPath string, out string, renditions []*EncodeVideoToResolutionArgs, args *EncodeVideoToDashArgs) error {
+	input := ffmpeglib.Input(inPath)
+	split := input.Get("v:0").Split()
+
+	outArgs := ffmpeglib.KwArgs{
+		"c:a":             renditions[0].AudioCodec,
+		"b:a":             renditions[0].AudioBitRate,
+		"f":               "dash",
+		"seg_duration":    args.SegmentDuration,
+		"use_timeline":    args.UseTimeline,
+		"use_template":    args.UseTemplate,
+		"hls_playlist":    args.HLSPlaylist,
+		"adaptation_sets": "id=0,streams=v id=1,streams=a",
+	}
+
+	streams := []*ffmpeglib.Stream{}
+	for i, r := range renditions {
+		streams = append(streams, applyFilterChain(split.Get(strconv.Itoa(i)), r.VideoFilter))
+
+		outArgs[fmt.Sprintf("c:v:%d", i)] = r.VideoCodec
+		outArgs[fmt.Sprintf("b:v:%d", i)] = r.VideoBitRate
+
+		for k, v := range r.ExtraArgs {
+			outArgs[videoStreamOption(k, i)] = v
+		}
+	}
+
+	err := run(ctx, ffmpeglib.Output(append(streams, input.Get("a:0?")), out, outArgs))
+	if err != nil {
+		logger.Error("FFMPEG encode video to dash failed %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// run runs the ffmpeg command of s, overwriting existing outputs. ffmpeg is
+// killed once ctx is done, in which case the context's error is returned.
+func run(ctx context.Context, s *ffmpeglib.Stream) error {
+	s.Context = ctx
+
+	err := s.OverWriteOutput().ErrorToStdOut().Run()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// videoStreamOption scopes an output option like "pix_fmt" or "tag:v" to the
+// index-th video stream, e.g. "pix_fmt:v:1".
+func videoStreamOption(option string, index int) string {
+	name, _, _ := strings.Cut(option, ":")
+
+	return fmt.Sprintf("%s:v:%d", name, index)
+}
+
+// applyFilterChain adds every filter of a "name=args,name=args" chain as its
+// own node since ffmpeg-go escapes commas inside a single filter.
+func applyFilterChain(s *ffmpeglib.Stream, chain string) *ffmpeglib.Stream {
+	for _, f := range strings.Split(chain, ",") {
+		name, args, _ := strings.Cut(f, "=")
+
+		if args == "" {
+			s = s.Filter(name, nil)
+			continue
+		}
+
+		s = s.Filter(name, ffmpeglib.Args{args})
+	}
+
+	return s
+}
+
+// EncodeVideoToDash packages the renditions in ins into one DASH manifest
+// (and HLS playlists when enabled) with a video and an audio adaptation set.
+func EncodeVideoToDash(ctx context.Context, ins []string, out string, args *EncodeVideoToDashArgs) error {
+	streams := []*ffmpeglib.Stream{}
+	audio := []*ffmpeglib.Stream{}
+
+	for _, in := range ins {
+		input := ffmpeglib.Input(in)
+		streams = append(streams, input.Get("v:0"))
+		audio = append(audio, input.Get("a:0?"))
+	}
+
 	outArgs := ffmpeglib.KwArgs{
-		"c":            args.Copy,
-		"f":            "dash",
-		"seg_duration": args.SegmentDuration,
-		"use_timeline": args.UseTimeline,
-		"use_template": args.UseTemplate,
-	}
-
-	err := ffmpeglib.Input(in).
-		Output(out, outArgs).
-		OverWriteOutput().
-		ErrorToStdOut().
-		Run()
+		"c":               args.Copy,
+		"f":               "dash",
+		"seg_duration":    args.SegmentDuration,
+		"use_timeline":    args.UseTimeline,
+		"use_template":    args.UseTemplate,
+		"hls_playlist":    args.HLSPlaylist,
+		"adaptation_sets": "id=0,streams=v id=1,streams=a",
+	}
+
+	err := run(ctx, ffmpeglib.Output(append(streams, audio...), out, outArgs))
 	if err != nil {
 		logger.Error("FFMPEG encode video to dash failed %v", err)
+		return err
 	}
 
 	return nil
@@ -146,7 +320,7 @@ func GetVideoInfo(in string) (*VideoInfo, error) {
 		"-select_streams",
 		"v:0",
 		"-show_entries",
-		"stream=width,height,duration,codec_name,bit_rate",
+		"stream=width,height,duration,codec_name,bit_rate,closed_captions,sample_aspect_ratio,display_aspect_ratio,r_frame_rate,avg_frame_rate,pix_fmt,color_transfer,color_primaries,color_space:stream_tags=rotate:stream_side_data=rotation",
 		"-of",
 		"json",
 		in,
@@ -164,19 +338,163 @@ func GetVideoInfo(in string) (*VideoInfo, error) {
 	}
 
 	m := new(FileOutput)
-	json.Unmarshal([]byte(o), &m)
+	if err := json.Unmarshal(o, m); err != nil {
+		logger.Error("Unable to parse ffprobe output %v", err)
+		return nil, err
+	}
 
 	logger.Info("Video %q Info: %v", in, m)
 
+	if len(m.Streams) == 0 {
+		return nil, fmt.Errorf("%w in %q", ErrNoVideoStream, in)
+	}
+
 	return &m.Streams[0], nil
 }
 
+func GetSubtitleStreams(in string) ([]SubtitleStreamInfo, error) {
+	args := []string{
+		"-v",
+		"error",
+		"-select_streams",
+		"s",
+		"-show_entries",
+		"stream=index,codec_name:stream_tags=language,title",
+		"-of",
+		"json",
+		in,
+	}
+
+	o, err := exec.Command("ffprobe", args...).Output()
+	if err != nil {
+		logger.Error("FFprobe command failed %v", err)
+		return nil, err
+	}
+
+	type FileOutput struct {
+		Streams []SubtitleStreamInfo `json:"streams"`
+	}
+
+	m := new(FileOutput)
+	if err := json.Unmarshal(o, m); err != nil {
+		logger.Error("Unable to parse ffprobe output %v", err)
+		return nil, err
+	}
+
+	streams := []SubtitleStreamInfo{}
+	for _, s := range m.Streams {
+		if !textSubtitleCodecs[s.CodecName] {
+			logger.Warn("Skipping unsupported subtitle stream %d (%s) in %q", s.Index, s.CodecName, in)
+			continue
+		}
+
+		streams = append(streams, s)
+	}
+
+	return streams, nil
+}
+
+func ExtractSubtitleToWebVTT(ctx context.Context, in string, out string, streamIndex int) error {
+	err := run(ctx, ffmpeglib.Input(in).
+		Get(strconv.Itoa(streamIndex)).
+		Output(out, ffmpeglib.KwArgs{"c:s": "webvtt", "f": "webvtt"}))
+	if err != nil {
+		logger.Error("FFMPEG extract subtitle stream %d failed %v", streamIndex, err)
+		return err
+	}
+
+	return nil
+}
+
+// ExtractClosedCaptionsToWebVTT extracts CEA-608 captions carried inside the
+// video stream (A53 side data) using the lavfi movie source.
+func ExtractClosedCaptionsToWebVTT(ctx context.Context, in string, out string) error {
+	source := fmt.Sprintf("movie=%s[out0+subcc]", escapeFilterPath(in))
+
+	err := run(ctx, ffmpeglib.Input(source, ffmpeglib.KwArgs{"f": "lavfi"}).
+		Get("s").
+		Output(out, ffmpeglib.KwArgs{"c:s": "webvtt", "f": "webvtt"}))
+	if err != nil {
+		logger.Error("FFMPEG extract closed captions failed %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func escapeFilterPath(p string) string {
+	r := strings.NewReplacer(`\`, `\\\\`, `'`, `\\\'`, `:`, `\\:`)
+
+	return r.Replace(p)
+}
+
+// GetEncodingStartIndex picks the highest rendition that fits the source. The
+// options are listed in landscape, so the source is compared by its short and
+// long edge to match portrait videos to the same rung.
 func GetEncodingStartIndex(width int, height int) int {
+	short, long := min(width, height), max(width, height)
+
 	for i, v := range VideoEncodeOptions {
-		if v.Width <= width && v.Height <= height {
+		if v.Width <= long && v.Height <= short {
 			return i
 		}
 	}
 
-	return 0
+	return len(VideoEncodeOptions) - 1
+}
+
+// Rotation returns the display rotation of the stream in degrees, normalized
+// to [0, 360). The display matrix side data takes precedence over the legacy
+// rotate tag.
+func (v *VideoInfo) Rotation() int {
+	r := 0
+
+	for _, s := range v.SideDataList {
+		if s.Rotation != 0 {
+			r = s.Rotation
+			break
+		}
+	}
+
+	if r == 0 && v.Tags.Rotate != "" {
+		r, _ = strconv.Atoi(v.Tags.Rotate)
+	}
+
+	return ((r % 360) + 360) % 360
+}
+
+// DisplaySize returns the dimensions of the video after the display rotation
+// is applied, which is what ffmpeg outputs since it autorotates on decode.
+func (v *VideoInfo) DisplaySize() (int, int) {
+	if r := v.Rotation(); r == 90 || r == 270 {
+		return v.Height, v.Width
+	}
+
+	return v.Width, v.Height
+}
+
+// OrientedResolution returns the dimensions of the option rotated to match
+// the orientation of the source, e.g. 1080x1920 for a portrait video.
+func OrientedResolution(opt *VideoEncodeOption, width int, height int) (int, int) {
+	if height > width {
+		return opt.Height, opt.Width
+	}
+
+	return opt.Width, opt.Height
+}
+
+// ScaleFilter fits the source into a width x height box preserving its aspect
+// ratio. The constrained edge is fixed and the other is derived with -2 to
+// keep it even. With pad the output is letterboxed to exactly width x height.
+func ScaleFilter(srcWidth int, srcHeight int, width int, height int, pad bool) string {
+	filter := fmt.Sprintf("scale=-2:%d", height)
+	if srcWidth*height > srcHeight*width {
+		filter = fmt.Sprintf("scale=%d:-2", width)
+	}
+
+	if pad {
+		filter += fmt.Sprintf(",pad=%d:%d:(ow-iw)/2:(oh-ih)/2", width, height)
+	}
+
+	return filter
 }
@@ -0,0 +1,120 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/sagarmaheshwary/microservices-encode-service/internal/lib/logger"
+)
+
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space for job")
+
+var root string
+
+// Init sets the directory job directories are created in.
+func Init(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		logger.Error("Unable to create workspace directory %q: %v", dir, err)
+		return err
+	}
+
+	root = dir
+
+	logger.Info("Using workspace directory %q", root)
+
+	return nil
+}
+
+func Root() string {
+	return root
+}
+
+func JobDir(videoId string) string {
+	return path.Join(root, videoId)
+}
+
+// Create returns the job directory of the video, creating it when needed. An
+// existing directory is kept so an interrupted job can resume from it.
+func Create(videoId string) (string, error) {
+	dir := JobDir(videoId)
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		logger.Error("Unable to create job directory %q: %v", dir, err)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func Remove(videoId string) error {
+	dir := JobDir(videoId)
+
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Error("Unable to remove job directory %q: %v", dir, err)
+		return err
+	}
+
+	logger.Info("Removed job directory %q", dir)
+
+	return nil
+}
+
+// SweepOrphans removes job directories that weren't touched for maxAge. Newer
+// directories are kept since a redelivered message can still resume them.
+func SweepOrphans(maxAge time.Duration) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		logger.Error("Unable to read workspace directory %q: %v", root, err)
+		return err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		if err := Remove(e.Name()); err == nil {
+			removed++
+		}
+	}
+
+	logger.Info("Workspace sweep removed %d orphaned job directories", removed)
+
+	return nil
+}
+
+func FreeBytes() (uint64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(root, &stat); err != nil {
+		logger.Error("Unable to stat workspace filesystem %q: %v", root, err)
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// EnsureSpace returns ErrInsufficientDiskSpace unless the workspace has at
+// least required bytes free.
+func EnsureSpace(required uint64) error {
+	free, err := FreeBytes()
+	if err != nil {
+		return err
+	}
+
+	if free < required {
+		return fmt.Errorf("%w: %d bytes required, %d bytes free", ErrInsufficientDiskSpace, required, free)
+	}
+
+	return nil
+}